@@ -0,0 +1,555 @@
+// Package aggate aggregates Prometheus metrics pushed by many short-lived
+// clients, such as browsers, into a single set of families to be scraped.
+// It is the engine of prom-aggregation-gateway, and can be embedded to run
+// aggregation in other binaries and tests:
+//
+//	a := aggate.New(aggate.Options{})
+//	http.Handle("/push", a.PushHandler())
+//	http.Handle("/metrics", a.ScrapeHandler())
+package aggate
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+func lablesLessThan(a, b []*dto.LabelPair) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if *a[i].Name != *b[j].Name {
+			return *a[i].Name < *b[j].Name
+		}
+		if *a[i].Value != *b[j].Value {
+			return *a[i].Value < *b[j].Value
+		}
+		i++
+		j++
+	}
+	return len(a) < len(b)
+}
+
+// ByLabel sorts a slice of Metrics by their labels.
+type ByLabel []*dto.Metric
+
+func (a ByLabel) Len() int           { return len(a) }
+func (a ByLabel) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByLabel) Less(i, j int) bool { return lablesLessThan(a[i].Label, a[j].Label) }
+
+// Sort a slice of LabelPairs by name
+type ByName []*dto.LabelPair
+
+func (a ByName) Len() int           { return len(a) }
+func (a ByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByName) Less(i, j int) bool { return a[i].GetName() < a[j].GetName() }
+
+// Sort a slice of MetricFamilies by name
+type ByFamilyName []*dto.MetricFamily
+
+func (a ByFamilyName) Len() int           { return len(a) }
+func (a ByFamilyName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByFamilyName) Less(i, j int) bool { return a[i].GetName() < a[j].GetName() }
+
+func uint64ptr(a uint64) *uint64 {
+	return &a
+}
+
+func float64ptr(a float64) *float64 {
+	return &a
+}
+
+func mergeBuckets(a, b []*dto.Bucket) []*dto.Bucket {
+	output := []*dto.Bucket{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if *a[i].UpperBound < *b[j].UpperBound {
+			output = append(output, a[i])
+			i++
+		} else if *a[i].UpperBound > *b[j].UpperBound {
+			output = append(output, b[j])
+			j++
+		} else {
+			output = append(output, &dto.Bucket{
+				CumulativeCount: uint64ptr(*a[i].CumulativeCount + *b[j].CumulativeCount),
+				UpperBound:      a[i].UpperBound,
+				Exemplar:        newestExemplar(a[i].Exemplar, b[j].Exemplar),
+			})
+			i++
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		output = append(output, a[i])
+	}
+	for ; j < len(b); j++ {
+		output = append(output, b[j])
+	}
+	return output
+}
+
+// mergeMetric merges the pushed sample b into the stored sample a, keeping
+// the most recent exemplar of counters and histogram buckets.
+func mergeMetric(ty dto.MetricType, a, b *dto.Metric) *dto.Metric {
+	switch ty {
+	case dto.MetricType_COUNTER:
+		return &dto.Metric{
+			Label:       a.Label,
+			TimestampMs: newestTimestamp(a, b),
+			Counter: &dto.Counter{
+				Value:    float64ptr(*a.Counter.Value + *b.Counter.Value),
+				Exemplar: newestExemplar(a.Counter.Exemplar, b.Counter.Exemplar),
+			},
+		}
+
+	case dto.MetricType_GAUGE:
+		// No very meaninful way for us to merge gauges.  We'll sum them
+		// and clear out any gauges on scrape, as a best approximation, but
+		// this relies on client pushing with the same interval as we scrape.
+		return &dto.Metric{
+			Label:       a.Label,
+			TimestampMs: newestTimestamp(a, b),
+			Gauge: &dto.Gauge{
+				Value: float64ptr(*a.Gauge.Value + *b.Gauge.Value),
+			},
+		}
+
+	case dto.MetricType_HISTOGRAM:
+		return &dto.Metric{
+			Label:       a.Label,
+			TimestampMs: newestTimestamp(a, b),
+			Histogram: &dto.Histogram{
+				SampleCount: uint64ptr(*a.Histogram.SampleCount + *b.Histogram.SampleCount),
+				SampleSum:   float64ptr(*a.Histogram.SampleSum + *b.Histogram.SampleSum),
+				Bucket:      mergeBuckets(a.Histogram.Bucket, b.Histogram.Bucket),
+			},
+		}
+
+	case dto.MetricType_UNTYPED:
+		return &dto.Metric{
+			Label:       a.Label,
+			TimestampMs: newestTimestamp(a, b),
+			Untyped: &dto.Untyped{
+				Value: float64ptr(*a.Untyped.Value + *b.Untyped.Value),
+			},
+		}
+
+	case dto.MetricType_SUMMARY:
+		// No way of merging summaries, abort.
+		return nil
+	}
+
+	return nil
+}
+
+// Aggregator merges pushed metric families, summing the samples of series
+// with the same labels, and serves the result to be
+// scraped.  It is safe for concurrent use.
+type Aggregator struct {
+	tenant         string
+	limits         Limits
+	schema         *Schema
+	relabelConfigs []*RelabelConfig
+	normalize      NormalizeConfig
+	checks         SampleChecks
+	timestamps     string // Timestamp policy, e.g. TimestampsStrip
+	inference      TypeInference
+	helpPolicy     string            // e.g. HelpFirst
+	configHelp     map[string]string // HELP by family name, for HelpConfig
+	pushLimits     PushLimits
+	memory         *MemoryTracker // Shared by every tenant
+	queue          *MergeQueue    // If set, pushes are merged in the background
+	metrics        *Metrics       // Shared by every tenant
+	idempotency    *idempotencyCache
+
+	// familiesLock guards the families map; each family has its own lock.
+	familiesLock sync.RWMutex
+	families     map[string]*storedFamily
+
+	// countsLock guards the totals checked against limits when admitting a
+	// push.  It is taken after any family locks.
+	countsLock  sync.Mutex
+	series      int // Total number of series in families
+	numFamilies int // Number of families with series
+}
+
+// Options configure an Aggregator.  The zero value stores whatever is
+// pushed, strips timestamps and keeps the first HELP of each family.
+// Schema, RelabelConfigs and Normalize must have been compiled.
+type Options struct {
+	// Tenant labels the aggregator's self-metrics and logs.
+	Tenant string
+	Limits Limits
+	// Schema, if set, declares the only families clients may push.
+	Schema *Schema
+	// RelabelConfigs are applied to every push, after any transforms
+	// passed with it.
+	RelabelConfigs []*RelabelConfig
+	Normalize      NormalizeConfig
+	Checks         SampleChecks
+	// Timestamps is the timestamp policy, TimestampsStrip if empty.
+	Timestamps string
+	Inference  TypeInference
+	// HelpPolicy chooses between differing HELP texts, HelpFirst if empty.
+	HelpPolicy string
+	// ConfigHelp gives the HELP of families by name, for HelpConfig.
+	ConfigHelp map[string]string
+	PushLimits PushLimits
+	// Memory, if set, accounts for stored series.  Aggregators sharing one
+	// share its limits.
+	Memory *MemoryTracker
+	// Queue, if set, merges pushes to the push handler in the background.
+	Queue *MergeQueue
+	// Metrics, if set, counts refused series and pushes.  It may be shared
+	// by many Aggregators.
+	Metrics *Metrics
+	// IdempotencySize and IdempotencyTTL bound the cache of Idempotency-Keys
+	// seen by the push handler; zero size disables them.
+	IdempotencySize int
+	IdempotencyTTL  time.Duration
+}
+
+// New returns an empty Aggregator.
+func New(opts Options) *Aggregator {
+	a := &Aggregator{
+		tenant:         opts.Tenant,
+		limits:         opts.Limits,
+		schema:         opts.Schema,
+		relabelConfigs: opts.RelabelConfigs,
+		normalize:      opts.Normalize,
+		checks:         opts.Checks,
+		timestamps:     opts.Timestamps,
+		inference:      opts.Inference,
+		helpPolicy:     opts.HelpPolicy,
+		configHelp:     opts.ConfigHelp,
+		pushLimits:     opts.PushLimits,
+		memory:         opts.Memory,
+		queue:          opts.Queue,
+		metrics:        opts.Metrics,
+		families:       map[string]*storedFamily{},
+	}
+	if a.timestamps == "" {
+		a.timestamps = TimestampsStrip
+	}
+	if a.helpPolicy == "" {
+		a.helpPolicy = HelpFirst
+	}
+	if opts.IdempotencySize > 0 {
+		a.idempotency = newIdempotencyCache(opts.IdempotencySize, opts.IdempotencyTTL, opts.Memory)
+	}
+	a.memory.register(a)
+	return a
+}
+
+// validateFamily checks that a pushed family has valid, unique labels and
+// exemplars, that it matches its declaration if there is a schema, and that
+// its samples pass the enabled checks.
+func validateFamily(f *dto.MetricFamily, s *Schema, checks SampleChecks) error {
+	if err := s.check(f); err != nil {
+		return err
+	}
+	if err := checks.check(f); err != nil {
+		return err
+	}
+	if err := checkExemplars(f); err != nil {
+		return err
+	}
+
+	// Map of fingerprints we've seen before in this family
+	fingerprints := make(map[model.Fingerprint]struct{}, len(f.Metric))
+	for _, m := range f.Metric {
+		// Turn protobuf LabelSet into Prometheus model LabelSet
+		lset := make(model.LabelSet, len(m.Label)+1)
+		for _, p := range m.Label {
+			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
+		}
+		lset[model.MetricNameLabel] = model.LabelValue(f.GetName())
+		if err := lset.Validate(); err != nil {
+			return err
+		}
+		fingerprint := lset.Fingerprint()
+		if _, found := fingerprints[fingerprint]; found {
+			return fmt.Errorf("Duplicate labels: %v", lset)
+		}
+		fingerprints[fingerprint] = struct{}{}
+	}
+	return nil
+}
+
+// A Transform rewrites pushed families before they are validated and merged.
+type Transform func(families map[string]*dto.MetricFamily) error
+
+// parsedPush is a push that has been parsed, transformed and validated, and
+// is ready to merge.
+type parsedPush struct {
+	names    []string // Sorted
+	families map[string]*dto.MetricFamily
+}
+
+// Push parses a push in the text exposition format and merges it.  The
+// transforms are applied before the aggregator's own rules.  A push is
+// merged entirely or, on error, not at all.
+func (a *Aggregator) Push(r io.Reader, transforms ...Transform) error {
+	return a.push(r, expfmt.FmtText, transforms...)
+}
+
+// push parses a push in format, either text or delimited protobuf, and
+// merges it.
+func (a *Aggregator) push(r io.Reader, format expfmt.Format, transforms ...Transform) error {
+	p, err := a.parse(r, format, transforms...)
+	if err != nil {
+		return err
+	}
+	return a.merge(p)
+}
+
+// Merge merges families as if they had been pushed, keyed by name.  It
+// takes ownership of them.
+func (a *Aggregator) Merge(families map[string]*dto.MetricFamily, transforms ...Transform) error {
+	p, err := a.prepare(families, transforms...)
+	if err != nil {
+		return err
+	}
+	return a.merge(p)
+}
+
+// parse reads a push in format and prepares it for merging, without
+// touching any stored state.
+func (a *Aggregator) parse(r io.Reader, format expfmt.Format, transforms ...Transform) (*parsedPush, error) {
+	inFamilies, err := a.pushLimits.parse(r, format)
+	if err != nil {
+		return nil, err
+	}
+	return a.prepare(inFamilies, transforms...)
+}
+
+// prepare transforms and validates pushed families.
+func (a *Aggregator) prepare(inFamilies map[string]*dto.MetricFamily, transforms ...Transform) (*parsedPush, error) {
+	transforms = append(transforms,
+		RelabelTransform(a.relabelConfigs),
+		a.normalize.transform,
+		timestampTransform(a.timestamps),
+		a.inference.transform(a.schema))
+	for _, t := range transforms {
+		if err := t(inFamilies); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(inFamilies))
+	for name := range inFamilies {
+		if a.schema.drops(name) {
+			delete(inFamilies, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := inFamilies[name]
+
+		// Sort labels in case source sends them inconsistently
+		for _, m := range family.Metric {
+			sort.Sort(ByName(m.Label))
+		}
+
+		if err := validateFamily(family, a.schema, a.checks); err != nil {
+			return nil, err
+		}
+	}
+	return &parsedPush{names: names, families: inFamilies}, nil
+}
+
+// merge adds a parsed push to the stored families.
+func (a *Aggregator) merge(p *parsedPush) error {
+	names, inFamilies := p.names, p.families
+	stored := a.lockFamilies(names)
+	defer a.unlockFamilies(names, stored)
+
+	a.coercePushed(stored, names, inFamilies)
+
+	// Check the whole push before merging any of it, so a rejected push
+	// leaves nothing behind.
+	a.countsLock.Lock()
+	err := a.admit(stored, names, inFamilies)
+	a.countsLock.Unlock()
+	if err != nil {
+		return err
+	}
+	a.coerceStored(stored, names, inFamilies)
+
+	for i, name := range names {
+		family, sf := inFamilies[name], stored[i]
+		if sf.series == nil && len(family.Metric) == 0 {
+			continue
+		}
+		bytes := sf.bytes
+		sf.help = a.recordHelp(sf, name, family.Help, sf.help)
+		removed := sf.merge(family)
+		a.memory.add(sf.bytes - bytes)
+		if removed > 0 {
+			a.countsLock.Lock()
+			a.series -= removed
+			if sf.numSeries == 0 {
+				a.numFamilies--
+			}
+			a.countsLock.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// Snapshot returns the current families, sorted by name, and their series
+// sorted by label.  Stored series are never modified in place, so the result
+// may be used without any lock.  Each family is read as of its latest merge,
+// so pushes to several families may be only partly visible.
+func (a *Aggregator) Snapshot() []*dto.MetricFamily {
+	_, stored := a.storedFamilies()
+	families := make([]*dto.MetricFamily, 0, len(stored))
+	for _, sf := range stored {
+		if family := sf.current(); family != nil {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// handler serves the families from their cached expositions, so scraping
+// an unchanged family only copies bytes.
+func (a *Aggregator) handler(w http.ResponseWriter, r *http.Request) {
+	contentType := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(contentType))
+
+	if _, err := a.Scrape(w, contentType); err != nil {
+		http.Error(w, "An error has occurred during metrics encoding:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if contentType == expfmt.FmtOpenMetrics {
+		expfmt.FinalizeOpenMetrics(w)
+	}
+
+	// TODO reset gauges
+}
+
+// Scrape writes the stored families to w in format, from their cached
+// expositions, and returns the names of those it wrote.  It doesn't finish
+// an OpenMetrics exposition, so other families can be written after them
+// before expfmt.FinalizeOpenMetrics.
+func (a *Aggregator) Scrape(w io.Writer, format expfmt.Format) ([]string, error) {
+	names, stored := a.storedFamilies()
+	written := make([]string, 0, len(names))
+	for i, sf := range stored {
+		buf, err := sf.encode(format, a.memory)
+		if err != nil {
+			return written, err
+		}
+		if len(buf) == 0 {
+			continue
+		}
+		if _, err := w.Write(buf); err != nil {
+			return written, err
+		}
+		written = append(written, names[i])
+	}
+	return written, nil
+}
+
+// Gather implements prometheus.Gatherer, returning Snapshot, so the
+// aggregated families can be served alongside a process's own metrics with
+// prometheus.Gatherers and promhttp.HandlerFor.
+func (a *Aggregator) Gather() ([]*dto.MetricFamily, error) {
+	return a.Snapshot(), nil
+}
+
+// Counts returns the number of families and series stored.
+func (a *Aggregator) Counts() (families, series int) {
+	a.countsLock.Lock()
+	defer a.countsLock.Unlock()
+	return a.numFamilies, a.series
+}
+
+// ScrapeHandler returns a handler serving the stored families in the
+// format negotiated with the scraper.  Exemplars are only served in the
+// OpenMetrics and protobuf formats.
+func (a *Aggregator) ScrapeHandler() http.Handler {
+	return http.HandlerFunc(a.handler)
+}
+
+// MetadataHandler returns a handler describing the stored families in JSON.
+func (a *Aggregator) MetadataHandler() http.Handler {
+	return http.HandlerFunc(a.metadataHandler)
+}
+
+// PushHandler returns a handler accepting pushes, as ServePush.
+func (a *Aggregator) PushHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.ServePush(w, r)
+	})
+}
+
+// PushHeaders returns the request headers ServePush reads, which browsers
+// must be allowed to send cross-origin.
+func PushHeaders() []string {
+	return []string{"Content-Type", idempotencyKeyHeader, sampleRateHeader}
+}
+
+// ServePush answers a push request, in the text format or, if its
+// Content-Type says so, as delimited protobuf, which can carry exemplars.
+// Sampled counts are scaled up, and the transforms are applied before the
+// aggregator's own rules.  A push whose Idempotency-Key has already been
+// merged is not merged again.  With a merge queue, pushes are answered with
+// 202 once parsed.
+func (a *Aggregator) ServePush(w http.ResponseWriter, r *http.Request, transforms ...Transform) {
+	transforms = append([]Transform{a.sampleRateTransform(r)}, transforms...)
+	key := r.Header.Get(idempotencyKeyHeader)
+	format := expfmt.ResponseFormat(r.Header)
+	var err error
+	if a.queue != nil {
+		err = a.pushQueued(key, r.Body, format, transforms...)
+	} else {
+		err = a.pushOnce(key, r.Body, format, transforms...)
+	}
+	if err == errDuplicatePush {
+		w.Header().Set("Idempotent-Replayed", "true")
+		return
+	} else if err != nil {
+		httpError(w, err)
+		return
+	}
+	if a.queue != nil {
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// httpError answers a failed push, with 429 for exceeded limits, 413 for
+// pushes too large to read, 409 for concurrent pushes with the same
+// Idempotency-Key, 503 when the merge queue or the cache of
+// Idempotency-Keys is full and 400 otherwise.
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	switch e := err.(type) {
+	case *limitError:
+		code = http.StatusTooManyRequests
+	case *pushLimitError:
+		if e.tooLarge {
+			code = http.StatusRequestEntityTooLarge
+		}
+	case *conflictError:
+		code = http.StatusConflict
+	}
+	if err == errQueueFull || err == errTooManyInFlight {
+		code = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", queueRetryAfter)
+	}
+	log.Println(err)
+	http.Error(w, err.Error(), code)
+}
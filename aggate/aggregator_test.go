@@ -1,14 +1,47 @@
-package main
+package aggate
 
 import (
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/pmezard/go-difflib/difflib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 )
 
+func push(h http.Handler, path, header, value, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader(body))
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func scrape(h http.Handler, path, header, value string) string {
+	r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Body.String()
+}
+
+// newTestMux serves a's handlers as the gateway does.
+func newTestMux(a *Aggregator) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.ScrapeHandler())
+	mux.Handle("/api/v1/metadata", a.MetadataHandler())
+	mux.Handle("/metrics/", a.PushHandler())
+	return mux
+}
+
 const (
 	in1 = `
 # HELP gauge A gauge
@@ -154,16 +187,16 @@ func TestAggate(t *testing.T) {
 		{duplicateLabels, "", "", fmt.Errorf("%s", duplicateError), nil},
 		{reorderedLabels1, reorderedLabels2, reorderedLabelsResult, nil, nil},
 	} {
-		a := newAggate()
+		a := New(Options{})
 
-		if err := a.parseAndMerge(strings.NewReader(c.a)); err != nil {
+		if err := a.Push(strings.NewReader(c.a)); err != nil {
 			if c.err1 == nil {
 				t.Fatalf("Unexpected error: %s", err)
 			} else if c.err1.Error() != err.Error() {
 				t.Fatalf("Expected %s, got %s", c.err1, err)
 			}
 		}
-		if err := a.parseAndMerge(strings.NewReader(c.b)); err != c.err2 {
+		if err := a.Push(strings.NewReader(c.b)); err != c.err2 {
 			t.Fatalf("Expected %s, got %s", c.err2, err)
 		}
 
@@ -183,3 +216,56 @@ func TestAggate(t *testing.T) {
 		}
 	}
 }
+
+func TestMerge(t *testing.T) {
+	a := New(Options{})
+	for _, in := range []string{multilabel1, multilabel2} {
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(strings.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Merge(families); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if have := scrape(a.ScrapeHandler(), "/metrics", "", ""); have != multilabelResult {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", multilabelResult, have)
+	}
+
+	// Merged families are validated like pushes.
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(duplicateLabels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Merge(families); err == nil || err.Error() != duplicateError {
+		t.Fatalf("Expected %s, got %v", duplicateError, err)
+	}
+	if families, series := a.Counts(); families != 1 || series != 1 {
+		t.Fatalf("Expected 1 family and series, have %d and %d", families, series)
+	}
+}
+
+func TestGatherers(t *testing.T) {
+	a := New(Options{})
+	if err := a.Push(strings.NewReader(gaugeInput)); err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "process_counter", Help: "A process counter"}))
+
+	h := promhttp.HandlerFor(prometheus.Gatherers{a, reg}, promhttp.HandlerOpts{})
+	want := `# HELP process_counter A process counter
+# TYPE process_counter counter
+process_counter 0
+# HELP ui_external_lib_loaded A gauge with entries in un-sorted order
+# TYPE ui_external_lib_loaded gauge
+ui_external_lib_loaded{loaded="true",name="Intercom"} 1
+ui_external_lib_loaded{loaded="true",name="ga"} 1
+ui_external_lib_loaded{loaded="true",name="mixpanel"} 1
+`
+	if have := scrape(h, "/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+}
@@ -0,0 +1,173 @@
+package aggate
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// benchmarkSizes are the shapes of push benchmarked: a browser's handful of
+// families, a busy page's many series, and wide histograms.
+var benchmarkSizes = []struct {
+	name                      string
+	families, series, buckets int
+}{
+	{"small", 5, 5, 10},
+	{"many-families", 200, 5, 10},
+	{"many-series", 5, 1000, 10},
+	{"wide-histograms", 5, 20, 100},
+}
+
+// syntheticPush returns a push like a browser's, with families counters,
+// gauges and histograms of series series each, histograms having buckets
+// buckets.  Pushes from different clients have the same series.
+func syntheticPush(families, series, buckets, client int) string {
+	var b strings.Builder
+	for f := 0; f < families; f++ {
+		switch f % 3 {
+		case 0:
+			fmt.Fprintf(&b, "# HELP ui_errors_%d_total A counter\n# TYPE ui_errors_%d_total counter\n", f, f)
+			for s := 0; s < series; s++ {
+				fmt.Fprintf(&b, "ui_errors_%d_total{path=\"/page/%d/:orgId\",loaded=\"true\"} %d\n", f, s, client%3+1)
+			}
+		case 1:
+			fmt.Fprintf(&b, "# HELP ui_lib_loaded_%d A gauge\n# TYPE ui_lib_loaded_%d gauge\n", f, f)
+			for s := 0; s < series; s++ {
+				fmt.Fprintf(&b, "ui_lib_loaded_%d{name=\"lib%d\",loaded=\"true\"} 1\n", f, s)
+			}
+		case 2:
+			fmt.Fprintf(&b, "# HELP ui_load_seconds_%d A histogram\n# TYPE ui_load_seconds_%d histogram\n", f, f)
+			for s := 0; s < series; s++ {
+				for i := 0; i < buckets; i++ {
+					fmt.Fprintf(&b, "ui_load_seconds_%d_bucket{path=\"/page/%d/:orgId\",le=\"%g\"} %d\n", f, s, 0.01*float64(i+1), (i+client)/buckets)
+				}
+				fmt.Fprintf(&b, "ui_load_seconds_%d_bucket{path=\"/page/%d/:orgId\",le=\"+Inf\"} 1\n", f, s)
+				fmt.Fprintf(&b, "ui_load_seconds_%d_sum{path=\"/page/%d/:orgId\"} 0.5\n", f, s)
+				fmt.Fprintf(&b, "ui_load_seconds_%d_count{path=\"/page/%d/:orgId\"} 1\n", f, s)
+			}
+		}
+	}
+	return b.String()
+}
+
+func BenchmarkParseAndMerge(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.name, func(b *testing.B) {
+			push := syntheticPush(size.families, size.series, size.buckets, 0)
+			a := New(Options{})
+			b.SetBytes(int64(len(push)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := a.Push(strings.NewReader(push)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMergeFamily merges already parsed families into stored ones,
+// leaving out parsing.
+func BenchmarkMergeFamily(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.name, func(b *testing.B) {
+			a := New(Options{})
+			p, err := a.parse(strings.NewReader(syntheticPush(size.families, size.series, size.buckets, 0)), expfmt.FmtText)
+			if err != nil {
+				b.Fatal(err)
+			}
+			stored := make([]*storedFamily, len(p.names))
+			for i, name := range p.names {
+				stored[i] = newStoredFamily(name, false)
+				stored[i].merge(p.families[name])
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j, name := range p.names {
+					stored[j].merge(p.families[name])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMergeBuckets(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			// The second histogram has every other bound of the first, plus
+			// bounds between them.
+			var x, y []*dto.Bucket
+			for i := 0; i < n; i++ {
+				x = append(x, &dto.Bucket{UpperBound: float64ptr(float64(i)), CumulativeCount: uint64ptr(uint64(i))})
+				y = append(y, &dto.Bucket{UpperBound: float64ptr(float64(i) + float64(i%2)/2), CumulativeCount: uint64ptr(uint64(i))})
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mergeBuckets(x, y)
+			}
+		})
+	}
+}
+
+func BenchmarkHandler(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.name, func(b *testing.B) {
+			a := New(Options{})
+			if err := a.Push(strings.NewReader(syntheticPush(size.families, size.series, size.buckets, 0))); err != nil {
+				b.Fatal(err)
+			}
+			h := http.HandlerFunc(a.handler)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Each scrape follows a push, so nothing is served from the
+				// encoded cache.
+				b.StopTimer()
+				if err := a.Push(strings.NewReader(syntheticPush(size.families, 1, size.buckets, i))); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				scrape(h, "/metrics", "", "")
+			}
+		})
+	}
+}
+
+// BenchmarkConcurrentPushAndScrape has many pushers and the occasional
+// scraper share one aggregator, as in production.
+func BenchmarkConcurrentPushAndScrape(b *testing.B) {
+	for _, scrapeEvery := range []int{10, 100} {
+		b.Run(fmt.Sprintf("scrape-every-%d", scrapeEvery), func(b *testing.B) {
+			a := New(Options{})
+			h := http.HandlerFunc(a.handler)
+			pushes := make([]string, 16)
+			for i := range pushes {
+				pushes[i] = syntheticPush(20, 10, 10, i)
+			}
+			var n int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&n, 1)
+					if i%int64(scrapeEvery) == 0 {
+						scrape(h, "/metrics", "", "")
+						continue
+					}
+					if err := a.Push(strings.NewReader(pushes[i%int64(len(pushes))])); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package aggate
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// SampleChecks are optional checks on pushed sample values, which would
+// otherwise silently poison the aggregate.
+type SampleChecks struct {
+	negativeCounters  bool
+	nanValues         bool
+	decreasingBuckets bool
+	infBucketCount    bool
+	missingInfBucket  bool
+}
+
+// sampleCheckNames maps the names accepted by ParseSampleChecks to the
+// checks they enable.
+var sampleCheckNames = map[string]func(*SampleChecks){
+	"negative-counters":  func(c *SampleChecks) { c.negativeCounters = true },
+	"nan-values":         func(c *SampleChecks) { c.nanValues = true },
+	"decreasing-buckets": func(c *SampleChecks) { c.decreasingBuckets = true },
+	"inf-bucket-count":   func(c *SampleChecks) { c.infBucketCount = true },
+	"missing-inf-bucket": func(c *SampleChecks) { c.missingInfBucket = true },
+}
+
+// ParseSampleChecks parses a comma-separated list of check names, or "all".
+func ParseSampleChecks(s string) (SampleChecks, error) {
+	var c SampleChecks
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "all":
+			for _, enable := range sampleCheckNames {
+				enable(&c)
+			}
+			continue
+		}
+		enable, ok := sampleCheckNames[name]
+		if !ok {
+			return c, fmt.Errorf("Unknown sample check %q", name)
+		}
+		enable(&c)
+	}
+	return c, nil
+}
+
+// check applies the enabled checks to every series in f.
+func (c SampleChecks) check(f *dto.MetricFamily) error {
+	for _, m := range f.Metric {
+		if err := c.checkMetric(f.GetType(), m); err != nil {
+			return fmt.Errorf("Invalid series %s: %v", seriesString(f.GetName(), m), err)
+		}
+	}
+	return nil
+}
+
+func (c SampleChecks) checkMetric(ty dto.MetricType, m *dto.Metric) error {
+	switch ty {
+	case dto.MetricType_COUNTER:
+		v := m.GetCounter().GetValue()
+		if c.nanValues && math.IsNaN(v) {
+			return fmt.Errorf("counter is NaN")
+		}
+		if c.negativeCounters && v < 0 {
+			return fmt.Errorf("counter is negative (%g)", v)
+		}
+
+	case dto.MetricType_GAUGE:
+		if c.nanValues && math.IsNaN(m.GetGauge().GetValue()) {
+			return fmt.Errorf("gauge is NaN")
+		}
+
+	case dto.MetricType_UNTYPED:
+		if c.nanValues && math.IsNaN(m.GetUntyped().GetValue()) {
+			return fmt.Errorf("value is NaN")
+		}
+
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		if c.nanValues && math.IsNaN(h.GetSampleSum()) {
+			return fmt.Errorf("histogram sum is NaN")
+		}
+		var inf *dto.Bucket
+		for i, b := range h.Bucket {
+			if c.decreasingBuckets && i > 0 && b.GetCumulativeCount() < h.Bucket[i-1].GetCumulativeCount() {
+				return fmt.Errorf("bucket le=\"%g\" count %d is less than bucket le=\"%g\" count %d",
+					b.GetUpperBound(), b.GetCumulativeCount(),
+					h.Bucket[i-1].GetUpperBound(), h.Bucket[i-1].GetCumulativeCount())
+			}
+			if math.IsInf(b.GetUpperBound(), +1) {
+				inf = b
+			}
+		}
+		if inf == nil {
+			if c.missingInfBucket {
+				return fmt.Errorf("histogram has no le=\"+Inf\" bucket")
+			}
+		} else if c.infBucketCount && inf.GetCumulativeCount() != h.GetSampleCount() {
+			return fmt.Errorf("bucket le=\"+Inf\" count %d does not match histogram count %d",
+				inf.GetCumulativeCount(), h.GetSampleCount())
+		}
+	}
+	return nil
+}
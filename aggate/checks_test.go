@@ -0,0 +1,100 @@
+package aggate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSampleChecks(t *testing.T) {
+	for _, c := range []struct {
+		checks, in, err string
+	}{
+		{
+			checks: "negative-counters",
+			in: `# TYPE counter counter
+counter{a="a"} -1
+`,
+			err: `Invalid series {__name__="counter", a="a"}: counter is negative (-1)`,
+		},
+		{
+			checks: "nan-values",
+			in: `# TYPE gauge gauge
+gauge{a="a"} NaN
+`,
+			err: `Invalid series {__name__="gauge", a="a"}: gauge is NaN`,
+		},
+		{
+			checks: "decreasing-buckets",
+			in: `# TYPE histogram histogram
+histogram_bucket{le="1"} 3
+histogram_bucket{le="2"} 2
+histogram_bucket{le="+Inf"} 3
+histogram_sum 4
+histogram_count 3
+`,
+			err: `Invalid series {__name__="histogram"}: bucket le="2" count 2 is less than bucket le="1" count 3`,
+		},
+		{
+			checks: "inf-bucket-count",
+			in: `# TYPE histogram histogram
+histogram_bucket{le="1"} 1
+histogram_bucket{le="+Inf"} 3
+histogram_sum 4
+histogram_count 2
+`,
+			err: `Invalid series {__name__="histogram"}: bucket le="+Inf" count 3 does not match histogram count 2`,
+		},
+		{
+			checks: "missing-inf-bucket",
+			in: `# TYPE histogram histogram
+histogram_bucket{le="1"} 1
+histogram_sum 4
+histogram_count 2
+`,
+			err: `Invalid series {__name__="histogram"}: histogram has no le="+Inf" bucket`,
+		},
+		{
+			// Each check is independent of the others.
+			checks: "negative-counters,nan-values,inf-bucket-count,missing-inf-bucket",
+			in: `# TYPE histogram histogram
+histogram_bucket{le="1"} 3
+histogram_bucket{le="2"} 2
+histogram_bucket{le="+Inf"} 3
+histogram_sum 4
+histogram_count 3
+`,
+		},
+		{
+			checks: "",
+			in: `# TYPE counter counter
+counter -1
+# TYPE gauge gauge
+gauge NaN
+`,
+		},
+		{
+			checks: "all",
+			in:     in1,
+			err:    `Invalid series {__name__="histogram"}: bucket le="+Inf" count 4 does not match histogram count 1`,
+		},
+	} {
+		checks, err := ParseSampleChecks(c.checks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := New(Options{})
+		a.checks = checks
+		err = a.Push(strings.NewReader(c.in))
+		if c.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.checks, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("%s: expected error %q, got %v", c.checks, c.err, err)
+		}
+	}
+}
+
+func TestParseSampleChecks(t *testing.T) {
+	if _, err := ParseSampleChecks("negative-counters,bogus"); err == nil {
+		t.Fatal("Expected error for unknown check")
+	}
+}
@@ -0,0 +1,83 @@
+package aggate
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// maxExemplarRunes is the most runes OpenMetrics allows in the names and
+// values of an exemplar's labels together.
+const maxExemplarRunes = 128
+
+// newestExemplar returns whichever of the exemplars of two merged samples is
+// the most recent: the one with the later timestamp if both have one, and
+// otherwise b, which was pushed after a.
+func newestExemplar(a, b *dto.Exemplar) *dto.Exemplar {
+	switch {
+	case b == nil:
+		return a
+	case a == nil:
+		return b
+	case a.Timestamp != nil && b.Timestamp != nil && timestampAfter(a, b):
+		return a
+	}
+	return b
+}
+
+func timestampAfter(a, b *dto.Exemplar) bool {
+	if a.Timestamp.Seconds != b.Timestamp.Seconds {
+		return a.Timestamp.Seconds > b.Timestamp.Seconds
+	}
+	return a.Timestamp.Nanos > b.Timestamp.Nanos
+}
+
+// checkExemplars checks the exemplars of a pushed family's counters and
+// histogram buckets, which are the only samples that may carry them.
+func checkExemplars(f *dto.MetricFamily) error {
+	for _, m := range f.Metric {
+		if err := checkExemplar(f.GetName(), m.GetCounter().GetExemplar()); err != nil {
+			return err
+		}
+		for _, b := range m.GetHistogram().GetBucket() {
+			if err := checkExemplar(f.GetName(), b.GetExemplar()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkExemplar(name string, e *dto.Exemplar) error {
+	if e == nil {
+		return nil
+	}
+	runes := 0
+	for _, p := range e.Label {
+		if !model.LabelName(p.GetName()).IsValid() {
+			return fmt.Errorf("Exemplar of metric '%s' has invalid label name %q", name, p.GetName())
+		}
+		if !model.LabelValue(p.GetValue()).IsValid() {
+			return fmt.Errorf("Exemplar of metric '%s' has invalid label value %q", name, p.GetValue())
+		}
+		runes += utf8.RuneCountInString(p.GetName()) + utf8.RuneCountInString(p.GetValue())
+	}
+	if runes > maxExemplarRunes {
+		return fmt.Errorf("Exemplar of metric '%s' has labels longer than %d runes", name, maxExemplarRunes)
+	}
+	return nil
+}
+
+// exemplarBytes estimates the memory used by a stored exemplar.
+func exemplarBytes(e *dto.Exemplar) int {
+	if e == nil {
+		return 0
+	}
+	bytes := valueOverhead
+	for _, p := range e.Label {
+		bytes += labelOverhead + len(p.GetName()) + len(p.GetValue())
+	}
+	return bytes
+}
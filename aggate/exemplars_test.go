@@ -0,0 +1,122 @@
+package aggate
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func exemplar(traceID string, value float64, seconds int64) *dto.Exemplar {
+	return &dto.Exemplar{
+		Label:     []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String(traceID)}},
+		Value:     proto.Float64(value),
+		Timestamp: &timestamp.Timestamp{Seconds: seconds},
+	}
+}
+
+// exemplarPush returns a push of a counter and a histogram, with the given
+// exemplars on the counter and on each of the histogram's two buckets.
+func exemplarPush(t *testing.T, counter, fast, slow *dto.Exemplar) string {
+	families := parseText(t, `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5"} 1
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_sum 0.3
+latency_seconds_count 1
+# TYPE requests_total counter
+requests_total{path="/"} 1
+`)
+	buckets := families[0].Metric[0].Histogram.Bucket
+	buckets[0].Exemplar, buckets[1].Exemplar = fast, slow
+	families[1].Metric[0].Counter.Exemplar = counter
+	return protobufPush(t, families...)
+}
+
+func TestExemplars(t *testing.T) {
+	a := New(Options{})
+	mux := newTestMux(a)
+	for _, in := range []string{
+		exemplarPush(t, exemplar("a", 1, 100), exemplar("a", 0.3, 100), nil),
+		exemplarPush(t, exemplar("b", 1, 200), nil, exemplar("b", 0.7, 200)),
+		// An exemplar older than the stored one doesn't replace it.
+		exemplarPush(t, exemplar("c", 1, 150), exemplar("c", 0.2, 50), nil),
+	} {
+		if w := pushProtobuf(mux, in); w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+	r.Header.Set("Accept", expfmt.OpenMetricsType+"; version="+expfmt.OpenMetricsVersion)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if have := w.Header().Get("Content-Type"); have != string(expfmt.FmtOpenMetrics) {
+		t.Fatalf("Expected Content-Type %q, got %q", expfmt.FmtOpenMetrics, have)
+	}
+	want := `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5"} 3 # {trace_id="a"} 0.3 100.0
+latency_seconds_bucket{le="+Inf"} 3 # {trace_id="b"} 0.7 200.0
+latency_seconds_sum 0.8999999999999999
+latency_seconds_count 3
+# TYPE requests counter
+requests_total{path="/"} 3.0 # {trace_id="b"} 1.0 200.0
+# EOF
+`
+	if have := w.Body.String(); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+
+	// The text format has no exemplars, but protobuf does.
+	if have := scrape(mux, "/metrics", "", ""); bytes.Contains([]byte(have), []byte("trace_id")) {
+		t.Fatalf("Text scrape should not have exemplars, got:\n%s", have)
+	}
+	r.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	dec := expfmt.NewDecoder(w.Body, expfmt.FmtProtoDelim)
+	var f dto.MetricFamily
+	for _, name := range []string{"latency_seconds", "requests_total"} {
+		if err := dec.Decode(&f); err != nil || f.GetName() != name {
+			t.Fatalf("Expected family %s, got %s: %v", name, f.GetName(), err)
+		}
+	}
+	if e := f.Metric[0].Counter.Exemplar; !proto.Equal(e, exemplar("b", 1, 200)) {
+		t.Fatalf("Expected the newest exemplar, got %v", e)
+	}
+}
+
+func TestExemplarsRejectedIfInvalid(t *testing.T) {
+	long := exemplar(string(make([]byte, maxExemplarRunes)), 1, 100)
+	invalid := exemplar("a", 1, 100)
+	invalid.Label[0].Name = proto.String("trace-id")
+	for _, c := range []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"too long", exemplarPush(t, long, nil, nil), "Exemplar of metric 'requests_total' has labels longer than 128 runes"},
+		{"invalid label", exemplarPush(t, nil, invalid, nil), `Exemplar of metric 'latency_seconds' has invalid label name "trace-id"`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a := New(Options{})
+			w := pushProtobuf(a.PushHandler(), c.in)
+			if w.Code != http.StatusBadRequest || !bytes.Contains(w.Body.Bytes(), []byte(c.err)) {
+				t.Fatalf("Expected 400 with %q, got %d: %s", c.err, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestMemoryAccountsForExemplars(t *testing.T) {
+	m := &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(1)}}
+	without := seriesBytes(m)
+	m.Counter.Exemplar = exemplar("4bf92f3577b34da6", 1, 100)
+	if have, want := seriesBytes(m)-without, int64(valueOverhead+labelOverhead+len("trace_id")+len("4bf92f3577b34da6")); have != want {
+		t.Fatalf("Expected an exemplar to account for %d bytes, got %d", want, have)
+	}
+}
@@ -0,0 +1,165 @@
+package aggate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Policies choosing a family's HELP when clients push different texts.
+const (
+	HelpFirst      = "first"       // Keep the HELP of the first push
+	HelpLast       = "last"        // Use the HELP of the latest push
+	HelpMostCommon = "most-common" // Use the HELP sent by the most pushes
+	HelpConfig     = "config"      // Use the configured HELP, else the first
+)
+
+const (
+	// maxHelpLength bounds the bytes of HELP kept from a push; longer
+	// texts are truncated.
+	maxHelpLength = 1024
+	// maxHelpVariants bounds the distinct HELP texts counted per family.
+	// Pushes of further texts are only counted together.
+	maxHelpVariants = 10
+)
+
+// ValidateHelpPolicy checks that policy is one of the HELP policies.
+func ValidateHelpPolicy(policy string) error {
+	switch policy {
+	case HelpFirst, HelpLast, HelpMostCommon, HelpConfig:
+		return nil
+	}
+	return fmt.Errorf("Unknown HELP policy %q", policy)
+}
+
+// recordHelp counts the HELP of a push to family name, and returns the HELP
+// the family should have afterwards, given its current one.  Pushes without
+// HELP don't change it.  sf must be locked.
+func (a *Aggregator) recordHelp(sf *storedFamily, name string, help, current *string) *string {
+	if a.helpPolicy == HelpConfig {
+		if text, ok := a.configHelp[name]; ok {
+			current = &text
+		}
+	}
+	if help == nil || *help == "" {
+		return current
+	}
+	if len(*help) > maxHelpLength {
+		text := truncateHelp(*help)
+		help = &text
+	}
+	if _, ok := sf.helps[*help]; ok {
+		sf.helps[*help]++
+	} else if len(sf.helps) < maxHelpVariants {
+		sf.helps[*help]++
+		sf.bytes += helpOverhead + int64(len(*help))
+	} else {
+		sf.otherHelps++
+	}
+
+	if current == nil || *current == "" {
+		return help
+	}
+	switch a.helpPolicy {
+	case HelpLast:
+		return help
+	case HelpMostCommon:
+		// Only the pushed text's count changed, so it is the only one
+		// that can overtake the current HELP.
+		if sf.helps[*help] > sf.helps[*current] {
+			return help
+		}
+	}
+	return current
+}
+
+// truncateHelp cuts help to at most maxHelpLength bytes, without splitting
+// a UTF-8 sequence.
+func truncateHelp(help string) string {
+	n := maxHelpLength
+	for n > 0 && !utf8.RuneStart(help[n]) {
+		n--
+	}
+	return help[:n]
+}
+
+// familyMetadata describes a stored family on the metadata endpoint.
+type familyMetadata struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Help   string `json:"help"`
+	Unit   string `json:"unit"`
+	Series int    `json:"series"`
+	// HelpVariants lists the HELP pushed for the family, most pushed first.
+	// Only the first few distinct texts are listed; pushes of any others
+	// are counted in OtherHelpPushes.
+	HelpVariants    []helpVariant `json:"help_variants"`
+	OtherHelpPushes int           `json:"other_help_pushes,omitempty"`
+}
+
+type helpVariant struct {
+	Help   string `json:"help"`
+	Pushes int    `json:"pushes"`
+}
+
+// baseUnits are the units conventionally found at the end of metric names.
+var baseUnits = []string{"seconds", "bytes", "ratio", "celsius", "meters", "grams", "joules", "volts", "amperes"}
+
+// unit guesses the unit of a family from its name, as the text format has
+// no way to declare one.
+func unit(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+	for _, u := range baseUnits {
+		if strings.HasSuffix(name, "_"+u) {
+			return u
+		}
+	}
+	return ""
+}
+
+// metadata describes every stored family, sorted by name.
+func (a *Aggregator) metadata() []familyMetadata {
+	names, stored := a.storedFamilies()
+	output := make([]familyMetadata, 0, len(stored))
+	for i, name := range names {
+		sf := stored[i]
+		sf.lock.Lock()
+		if sf.numSeries == 0 {
+			sf.lock.Unlock()
+			continue
+		}
+		md := familyMetadata{
+			Name:            name,
+			Type:            strings.ToLower(sf.metricType.String()),
+			Unit:            unit(name),
+			Series:          sf.numSeries,
+			HelpVariants:    make([]helpVariant, 0, len(sf.helps)),
+			OtherHelpPushes: sf.otherHelps,
+		}
+		if sf.help != nil {
+			md.Help = *sf.help
+		}
+		for text, pushes := range sf.helps {
+			md.HelpVariants = append(md.HelpVariants, helpVariant{Help: text, Pushes: pushes})
+		}
+		sf.lock.Unlock()
+
+		sort.Slice(md.HelpVariants, func(i, j int) bool {
+			vi, vj := md.HelpVariants[i], md.HelpVariants[j]
+			if vi.Pushes != vj.Pushes {
+				return vi.Pushes > vj.Pushes
+			}
+			return vi.Help < vj.Help
+		})
+		output = append(output, md)
+	}
+	return output
+}
+
+func (a *Aggregator) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.metadata())
+}
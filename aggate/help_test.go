@@ -0,0 +1,89 @@
+package aggate
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestHelpPolicy(t *testing.T) {
+	pushes := []string{
+		"# HELP requests_total Old help\n# TYPE requests_total counter\nrequests_total 1\n",
+		"# HELP requests_total New help\n# TYPE requests_total counter\nrequests_total 1\n",
+		"# HELP requests_total New help\n# TYPE requests_total counter\nrequests_total 1\n",
+		"# HELP requests_total Stale help\n# TYPE requests_total counter\nrequests_total 1\n",
+		"# TYPE requests_total counter\nrequests_total 1\n",
+	}
+	for _, c := range []struct {
+		policy, want string
+	}{
+		{HelpFirst, "Old help"},
+		{HelpLast, "Stale help"},
+		{HelpMostCommon, "New help"},
+		{HelpConfig, "Configured help"},
+	} {
+		a := New(Options{})
+		a.helpPolicy = c.policy
+		a.configHelp = map[string]string{"requests_total": "Configured help"}
+		for _, push := range pushes {
+			if err := a.Push(strings.NewReader(push)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := "# HELP requests_total " + c.want + "\n# TYPE requests_total counter\nrequests_total 5\n"
+		if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != want {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", c.policy, want, have)
+		}
+	}
+
+	if err := ValidateHelpPolicy("random"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	mux := newTestMux(New(Options{}))
+	for _, body := range []string{
+		"# HELP request_duration_seconds Old help\n# TYPE request_duration_seconds histogram\nrequest_duration_seconds_bucket{le=\"+Inf\"} 1\nrequest_duration_seconds_sum 1\nrequest_duration_seconds_count 1\n",
+		"# HELP request_duration_seconds New help\n# TYPE request_duration_seconds histogram\nrequest_duration_seconds_bucket{a=\"b\",le=\"+Inf\"} 1\nrequest_duration_seconds_sum{a=\"b\"} 1\nrequest_duration_seconds_count{a=\"b\"} 1\n",
+		multilabel1,
+	} {
+		if w := push(mux, "/metrics/", "", "", body); w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	want := `[{"name":"counter","type":"counter","help":"A counter","unit":"","series":1,"help_variants":[{"help":"A counter","pushes":1}]},` +
+		`{"name":"request_duration_seconds","type":"histogram","help":"Old help","unit":"seconds","series":2,"help_variants":[{"help":"New help","pushes":1},{"help":"Old help","pushes":1}]}]` + "\n"
+	if have := scrape(mux, "/api/v1/metadata", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+}
+
+func TestHelpVariantsBounded(t *testing.T) {
+	a := New(Options{})
+	a.helpPolicy = HelpMostCommon
+	for i := 0; i < maxHelpVariants+5; i++ {
+		push := fmt.Sprintf("# HELP requests_total Help %d\n# TYPE requests_total counter\nrequests_total 1\n", i)
+		if err := a.Push(strings.NewReader(push)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	long := "a" + strings.Repeat("é", maxHelpLength)
+	if err := a.Push(strings.NewReader("# HELP gauge " + long + "\n# TYPE gauge gauge\ngauge 1\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	md := a.metadata()
+	if len(md) != 2 {
+		t.Fatalf("Expected 2 families, got %+v", md)
+	}
+	if help := md[0].Help; len(help) > maxHelpLength || !utf8.ValidString(help) || !strings.HasPrefix(long, help) {
+		t.Errorf("Expected HELP truncated to valid UTF-8 within %d bytes, got %d bytes", maxHelpLength, len(help))
+	}
+	if len(md[1].HelpVariants) != maxHelpVariants || md[1].OtherHelpPushes != 5 {
+		t.Errorf("Expected %d variants and 5 other pushes, got %d and %d", maxHelpVariants, len(md[1].HelpVariants), md[1].OtherHelpPushes)
+	}
+}
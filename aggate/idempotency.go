@@ -0,0 +1,173 @@
+package aggate
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
+// errDuplicatePush is returned by pushOnce for a push whose key has already
+// been merged.  It is acknowledged with 200 like a successful push.
+var errDuplicatePush = fmt.Errorf("Duplicate push")
+
+// errTooManyInFlight is returned by pushOnce when every remembered key
+// belongs to a push still being merged, so none can be evicted to make room
+// for another.  It is answered with 503, like a full merge queue.
+var errTooManyInFlight = fmt.Errorf("Too many pushes with an %s being merged", idempotencyKeyHeader)
+
+// conflictError is returned when a push with the same key is still being
+// merged, and is answered with 409.
+type conflictError struct {
+	key string
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("A push with Idempotency-Key %q is in progress", e.key)
+}
+
+// idempotencyCache remembers recently seen Idempotency-Keys, so retried
+// pushes aren't counted twice.  It holds at most size keys, each for at most
+// ttl, evicting the least recently seen first.  Keys whose pushes are still
+// being merged are never evicted, as a retry would then be merged twice.  The
+// keys' memory is counted by memory.
+type idempotencyCache struct {
+	size   int
+	ttl    time.Duration
+	now    func() time.Time
+	memory *MemoryTracker
+
+	lock    sync.Mutex
+	lru     *list.List // Of *idempotencyEntry, most recently seen first
+	entries map[string]*list.Element
+}
+
+type idempotencyEntry struct {
+	key     string
+	expires time.Time
+	done    bool // False while the push is being merged
+}
+
+func newIdempotencyCache(size int, ttl time.Duration, memory *MemoryTracker) *idempotencyCache {
+	return &idempotencyCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		memory:  memory,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// reserve records key as being merged.  It returns errDuplicatePush if key
+// has already been merged, a conflictError if it is being merged, or
+// errTooManyInFlight if the cache is full of keys being merged.
+func (c *idempotencyCache) reserve(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*idempotencyEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			if entry.done {
+				return errDuplicatePush
+			}
+			return &conflictError{key: key}
+		}
+		c.remove(e)
+	}
+
+	for e := c.lru.Back(); e != nil && c.lru.Len() >= c.size; {
+		prev := e.Prev()
+		if e.Value.(*idempotencyEntry).done {
+			c.remove(e)
+		}
+		e = prev
+	}
+	if c.lru.Len() >= c.size {
+		return errTooManyInFlight
+	}
+
+	c.entries[key] = c.lru.PushFront(&idempotencyEntry{key: key, expires: now.Add(c.ttl)})
+	c.memory.add(idempotencyKeyOverhead + int64(len(key)))
+	return nil
+}
+
+// complete records that the push with key has been merged.
+func (c *idempotencyCache) complete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*idempotencyEntry).done = true
+	}
+}
+
+// release forgets key, as its push failed and may be retried.
+func (c *idempotencyCache) release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *idempotencyCache) remove(e *list.Element) {
+	key := e.Value.(*idempotencyEntry).key
+	c.lru.Remove(e)
+	delete(c.entries, key)
+	c.memory.add(-idempotencyKeyOverhead - int64(len(key)))
+}
+
+// pushOnce is Push for pushes carrying an Idempotency-Key: a push
+// whose key has already been merged is not merged again.
+func (a *Aggregator) pushOnce(key string, r io.Reader, format expfmt.Format, transforms ...Transform) error {
+	key, err := a.reserveKey(key)
+	if err != nil {
+		return err
+	}
+	err = a.push(r, format, transforms...)
+	a.finishKey(key, err)
+	return err
+}
+
+// reserveKey reserves a push's Idempotency-Key, returning the key to pass to
+// finishKey once the push has been merged or has failed; "" if the aggregator
+// doesn't track keys.
+func (a *Aggregator) reserveKey(key string) (string, error) {
+	if key == "" || a.idempotency == nil {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return "", fmt.Errorf("%s longer than %d bytes", idempotencyKeyHeader, maxIdempotencyKeyLen)
+	}
+
+	if err := a.idempotency.reserve(key); err != nil {
+		if err == errDuplicatePush {
+			a.metrics.duplicate(a.tenant)
+		}
+		return "", err
+	}
+	return key, nil
+}
+
+// finishKey records whether the push with a reserved key was merged, so a
+// failed push may be retried.
+func (a *Aggregator) finishKey(key string, err error) {
+	switch {
+	case key == "":
+	case err != nil:
+		a.idempotency.release(key)
+	default:
+		a.idempotency.complete(key)
+	}
+}
@@ -0,0 +1,92 @@
+package aggate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newIdempotencyCache(2, time.Minute, nil)
+	c.now = func() time.Time { return now }
+
+	if err := c.reserve("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := c.reserve("a").(*conflictError); !ok {
+		t.Fatalf("Expected conflict for in-flight key, got %v", err)
+	}
+	c.complete("a")
+	if err := c.reserve("a"); err != errDuplicatePush {
+		t.Fatalf("Expected duplicate, got %v", err)
+	}
+
+	// A failed push may be retried.
+	c.reserve("b")
+	c.release("b")
+	if err := c.reserve("b"); err != nil {
+		t.Fatal(err)
+	}
+	c.complete("b")
+
+	// "a" was seen more recently than "b", so "b" is evicted.
+	c.reserve("a")
+	c.reserve("c")
+	if err := c.reserve("b"); err != nil {
+		t.Fatalf("Expected evicted key to be forgotten, got %v", err)
+	}
+
+	// Keys expire after the TTL.
+	now = now.Add(2 * time.Minute)
+	if err := c.reserve("c"); err != nil {
+		t.Fatalf("Expected expired key to be forgotten, got %v", err)
+	}
+}
+
+func TestIdempotencyCacheKeepsInFlightKeys(t *testing.T) {
+	c := newIdempotencyCache(1, time.Minute, nil)
+	if err := c.reserve("a"); err != nil {
+		t.Fatal(err)
+	}
+	// "a" is still being merged, so it can't be evicted to make room.
+	if err := c.reserve("b"); err != errTooManyInFlight {
+		t.Fatalf("Expected errTooManyInFlight, got %v", err)
+	}
+	if err, ok := c.reserve("a").(*conflictError); !ok {
+		t.Fatalf("Expected conflict for in-flight key, got %v", err)
+	}
+
+	// Once merged, it can.
+	c.complete("a")
+	if err := c.reserve("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reserve("a"); err != errTooManyInFlight {
+		t.Fatalf("Expected errTooManyInFlight, got %v", err)
+	}
+}
+
+func TestIdempotentPush(t *testing.T) {
+	mux := newTestMux(New(Options{IdempotencySize: 10, IdempotencyTTL: time.Minute}))
+
+	for _, key := range []string{"1", "1", "2", ""} {
+		r := httptest.NewRequest("POST", "http://example.com/metrics/", strings.NewReader(multilabel1))
+		r.Header.Set(idempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	want := `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b"} 3
+`
+	if have := scrape(mux, "/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+}
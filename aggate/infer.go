@@ -0,0 +1,144 @@
+package aggate
+
+import (
+	"fmt"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TypeInference gives types to untyped families, which clients that omit
+// "# TYPE" lines push, so they can share families with typed clients.
+type TypeInference struct {
+	// totalSuffix makes untyped families named *_total counters.
+	totalSuffix bool
+	// schema gives untyped families their declared type.
+	schema bool
+	// existing converts untyped families to the type of the stored family,
+	// and stored untyped families to the type of a typed push.
+	existing bool
+}
+
+// typeInferenceNames maps the names accepted by ParseTypeInference to the
+// inferences they enable.
+var typeInferenceNames = map[string]func(*TypeInference){
+	"total-suffix": func(t *TypeInference) { t.totalSuffix = true },
+	"schema":       func(t *TypeInference) { t.schema = true },
+	"existing":     func(t *TypeInference) { t.existing = true },
+}
+
+// ParseTypeInference parses a comma-separated list of inference names, or
+// "all".
+func ParseTypeInference(s string) (TypeInference, error) {
+	var t TypeInference
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "all":
+			for _, enable := range typeInferenceNames {
+				enable(&t)
+			}
+			continue
+		}
+		enable, ok := typeInferenceNames[name]
+		if !ok {
+			return t, fmt.Errorf("Unknown type inference %q", name)
+		}
+		enable(&t)
+	}
+	return t, nil
+}
+
+// transform returns a Transform typing untyped families by their name or
+// declaration in s.
+func (t TypeInference) transform(s *Schema) Transform {
+	return func(families map[string]*dto.MetricFamily) error {
+		for name, family := range families {
+			if family.GetType() != dto.MetricType_UNTYPED {
+				continue
+			}
+			if fs := s.lookup(name); t.schema && fs != nil {
+				coerceFamily(family, fs.metricType)
+			} else if t.totalSuffix && strings.HasSuffix(name, "_total") {
+				coerceFamily(family, dto.MetricType_COUNTER)
+			}
+		}
+		return nil
+	}
+}
+
+// coercePushed converts untyped pushed families to the type of the stored
+// family.  Only the push is changed, so it may be rejected afterwards.  The
+// stored families must be locked.
+func (a *Aggregator) coercePushed(stored []*storedFamily, names []string, families map[string]*dto.MetricFamily) {
+	if !a.inference.existing {
+		return
+	}
+	for i, name := range names {
+		family, sf := families[name], stored[i]
+		if sf.series != nil && family.GetType() == dto.MetricType_UNTYPED {
+			coerceFamily(family, sf.metricType)
+		}
+	}
+}
+
+// coercesStored reports whether merging family will convert the stored
+// untyped family sf to family's type, rather than be refused.
+func (a *Aggregator) coercesStored(sf *storedFamily, family *dto.MetricFamily) bool {
+	return a.inference.existing && sf.series != nil &&
+		sf.metricType == dto.MetricType_UNTYPED && canCoerce(family.GetType())
+}
+
+// coerceStored converts stored untyped families to the type of the pushed
+// family.  It must only be called once the push has been admitted, so a
+// refused push leaves the stored types alone.  The stored families must be
+// locked.
+func (a *Aggregator) coerceStored(stored []*storedFamily, names []string, families map[string]*dto.MetricFamily) {
+	for i, name := range names {
+		family, sf := families[name], stored[i]
+		if len(family.Metric) == 0 || !a.coercesStored(sf, family) {
+			continue
+		}
+		// Stored series are never modified in place.
+		coerced := &dto.MetricFamily{Type: &sf.metricType}
+		for _, ss := range sf.series {
+			for _, s := range ss {
+				m := s.metric
+				coerced.Metric = append(coerced.Metric, &dto.Metric{Label: m.Label, Untyped: m.Untyped, TimestampMs: m.TimestampMs})
+			}
+		}
+		coerceFamily(coerced, family.GetType())
+		bytes := sf.bytes
+		sf.clear()
+		sf.merge(coerced)
+		a.memory.add(sf.bytes - bytes)
+	}
+}
+
+// canCoerce reports whether untyped samples can become samples of type ty.
+// Histograms and summaries are spread over several untyped families, so
+// cannot.
+func canCoerce(ty dto.MetricType) bool {
+	return ty == dto.MetricType_COUNTER || ty == dto.MetricType_GAUGE
+}
+
+// coerceFamily converts the samples of the untyped family f to type ty, if
+// possible.
+func coerceFamily(f *dto.MetricFamily, ty dto.MetricType) {
+	if f.GetType() != dto.MetricType_UNTYPED || !canCoerce(ty) {
+		return
+	}
+	f.Type = &ty
+	for _, m := range f.Metric {
+		value := m.GetUntyped().GetValue()
+		m.Untyped = nil
+		switch ty {
+		case dto.MetricType_COUNTER:
+			m.Counter = &dto.Counter{Value: float64ptr(value)}
+		case dto.MetricType_GAUGE:
+			m.Gauge = &dto.Gauge{Value: float64ptr(value)}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package aggate
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTypeInference(t *testing.T) {
+	const (
+		untyped = `requests_total{a="a"} 1
+temperature 20
+`
+		typed = `# TYPE requests_total counter
+requests_total{a="a"} 2
+# TYPE temperature gauge
+temperature 1
+`
+	)
+	s := &Schema{Families: []FamilySchema{
+		{Name: "requests_total", Type: "counter", Labels: map[string]LabelSchema{"a": {}}},
+		{Name: "temperature", Type: "gauge"},
+	}}
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		inference string
+		schema    *Schema
+		pushes    []string
+		want, err string
+	}{
+		{
+			inference: "",
+			pushes:    []string{untyped, typed},
+			err:       "Cannot merge metric 'requests_total': type UNTYPED != COUNTER",
+		},
+		{
+			inference: "total-suffix",
+			pushes:    []string{untyped, typed},
+			err:       "Cannot merge metric 'temperature': type UNTYPED != GAUGE",
+		},
+		{
+			inference: "schema",
+			schema:    s,
+			pushes:    []string{untyped, typed},
+			want: `# TYPE requests_total counter
+requests_total{a="a"} 3
+# TYPE temperature gauge
+temperature 21
+`,
+		},
+		{
+			inference: "existing",
+			pushes:    []string{typed, untyped},
+			want: `# TYPE requests_total counter
+requests_total{a="a"} 3
+# TYPE temperature gauge
+temperature 21
+`,
+		},
+		{
+			inference: "existing",
+			pushes:    []string{untyped, typed},
+			want: `# TYPE requests_total counter
+requests_total{a="a"} 3
+# TYPE temperature gauge
+temperature 21
+`,
+		},
+	} {
+		inference, err := ParseTypeInference(c.inference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := New(Options{})
+		a.inference = inference
+		a.schema = c.schema
+		for _, push := range c.pushes {
+			if err = a.Push(strings.NewReader(push)); err != nil {
+				break
+			}
+		}
+		if c.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+				t.Errorf("%s: expected error %q, got %v", c.inference, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.inference, err)
+		}
+		if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != c.want {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", c.inference, c.want, have)
+		}
+	}
+
+	if _, err := ParseTypeInference("guess"); err == nil {
+		t.Error("Expected error for unknown inference")
+	}
+}
+
+func TestRejectedPushKeepsStoredType(t *testing.T) {
+	a := New(Options{})
+	a.inference, _ = ParseTypeInference("existing")
+	a.limits = Limits{MaxSeries: 1}
+	if err := a.Push(strings.NewReader("temperature 20\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := a.Push(strings.NewReader(`# TYPE temperature gauge
+temperature 1
+temperature{room="kitchen"} 1
+`))
+	if _, ok := err.(*limitError); !ok {
+		t.Fatalf("Expected a limit error, got %v", err)
+	}
+	want := `# TYPE temperature untyped
+temperature 20
+`
+	if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != want {
+		t.Fatalf("Rejected push changed the stored family, expected:\n%s\ngot:\n%s", want, have)
+	}
+}
@@ -0,0 +1,101 @@
+package aggate
+
+import (
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelPool interns the label names and values of stored series, which
+// thousands of clients push identically.  Nil disables interning.
+var labelPool = newInterner()
+
+// internShards is the number of independently locked parts of an interner,
+// so pushes storing new series rarely wait for each other.
+const internShards = 64
+
+// interner hands out a single shared copy of each string, counting its
+// references so it can be forgotten once no stored series uses it.
+type interner struct {
+	shards [internShards]internShard
+}
+
+type internShard struct {
+	lock    sync.Mutex
+	strings map[string]*internedString
+}
+
+type internedString struct {
+	s    string
+	refs int
+}
+
+func newInterner() *interner {
+	i := &interner{}
+	for j := range i.shards {
+		i.shards[j].strings = map[string]*internedString{}
+	}
+	return i
+}
+
+// shard returns the part of the interner holding s.
+func (i *interner) shard(s string) *internShard {
+	h := uint64(offset64)
+	for j := 0; j < len(s); j++ {
+		h ^= uint64(s[j])
+		h *= prime64
+	}
+	return &i.shards[h%internShards]
+}
+
+func (i *interner) intern(s *string) *string {
+	if i == nil || s == nil {
+		return s
+	}
+	shard := i.shard(*s)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	is, ok := shard.strings[*s]
+	if !ok {
+		is = &internedString{s: *s}
+		shard.strings[*s] = is
+	}
+	is.refs++
+	return &is.s
+}
+
+func (i *interner) release(s *string) {
+	if i == nil || s == nil {
+		return
+	}
+	shard := i.shard(*s)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if is, ok := shard.strings[*s]; ok && &is.s == s {
+		if is.refs--; is.refs == 0 {
+			delete(shard.strings, *s)
+		}
+	}
+}
+
+// internLabels returns copies of a newly stored series' labels sharing
+// pooled strings.  The pairs themselves may be shared with snapshots, so are
+// not modified.
+func (i *interner) internLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	if i == nil {
+		return labels
+	}
+	interned := make([]*dto.LabelPair, len(labels))
+	for j, p := range labels {
+		interned[j] = &dto.LabelPair{Name: i.intern(p.Name), Value: i.intern(p.Value)}
+	}
+	return interned
+}
+
+// releaseLabels gives up a removed series' label strings.
+func (i *interner) releaseLabels(labels []*dto.LabelPair) {
+	for _, p := range labels {
+		i.release(p.Name)
+		i.release(p.Value)
+	}
+}
@@ -0,0 +1,113 @@
+package aggate
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLabelPool(t *testing.T) {
+	defer func(pool *interner) { labelPool = pool }(labelPool)
+	labelPool = newInterner()
+
+	a := New(Options{})
+	for _, in := range []string{gaugeInput, gaugeInput, labelFields1} {
+		if err := a.Push(strings.NewReader(in)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	// loaded, true, name, ga, Intercom, mixpanel, path and two paths.
+	if have, want := labelPool.size(), 9; have != want {
+		t.Fatalf("Expected %d pooled strings, got %d", want, have)
+	}
+	if have, want := labelPool.refs("true"), 3; have != want {
+		t.Fatalf("Expected %d references to \"true\", got %d", want, have)
+	}
+
+	// Summing a summary removes its series, releasing their labels.
+	if err := a.Push(strings.NewReader(`# TYPE s summary
+s{path="/org/:orgId",quantile="0.5"} 1
+s_sum{path="/org/:orgId"} 1
+s_count{path="/org/:orgId"} 1
+`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := a.Push(strings.NewReader("# TYPE s summary\ns_sum{path=\"/org/:orgId\"} 1\ns_count{path=\"/org/:orgId\"} 1\n")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if have, want := labelPool.size(), 9; have != want {
+		t.Fatalf("Expected %d pooled strings after removal, got %d", want, have)
+	}
+	if have, want := labelPool.refs("path"), 2; have != want {
+		t.Fatalf("Expected %d references to \"path\", got %d", want, have)
+	}
+}
+
+// size returns the number of strings pooled.
+func (i *interner) size() int {
+	n := 0
+	for j := range i.shards {
+		n += len(i.shards[j].strings)
+	}
+	return n
+}
+
+// refs returns the number of references to the pooled s.
+func (i *interner) refs(s string) int {
+	if is, ok := i.shard(s).strings[s]; ok {
+		return is.refs
+	}
+	return 0
+}
+
+// scaledFixtures returns the gauge and label fixtures as pushed by n
+// clients, each of which adds its own client label.
+func scaledFixtures(n int) []string {
+	pushes := make([]string, n)
+	for i := range pushes {
+		pushes[i] = strings.Replace(gaugeInput+labelFields1, "}", fmt.Sprintf(",client=\"%d\"}", i), -1)
+	}
+	return pushes
+}
+
+// BenchmarkStoredLabels reports the heap retained per stored series, with
+// and without the label pool.  Run with -memprofile to see where.
+func BenchmarkStoredLabels(b *testing.B) {
+	defer func(pool *interner) { labelPool = pool }(labelPool)
+	pushes := scaledFixtures(2000)
+	for _, c := range []struct {
+		name string
+		pool *interner
+	}{
+		{"plain", nil},
+		{"interned", newInterner()},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			labelPool = c.pool
+			b.ReportAllocs()
+			var retained uint64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				a := New(Options{})
+				for _, push := range pushes {
+					if err := a.Push(strings.NewReader(push)); err != nil {
+						b.Fatal(err)
+					}
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(a)
+				a.families = nil
+				if c.pool != nil {
+					labelPool = newInterner()
+				}
+			}
+			// b.ReportMetric needs Go 1.13.
+			b.Logf("%.0f retained bytes/series", float64(retained)/float64(b.N*len(pushes)*5))
+		})
+	}
+}
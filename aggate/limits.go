@@ -0,0 +1,177 @@
+package aggate
+
+import (
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Reject the whole push if any of its new series exceeds a limit.
+	PolicyReject = "reject"
+	// Drop the new series that exceed a limit, and merge the rest.
+	PolicyDrop = "drop"
+)
+
+// Limits bounds what a single aggregator (i.e. a single tenant) may store.
+// Zero means unlimited.
+type Limits struct {
+	MaxFamilies            int    `json:"max_families"`
+	MaxSeries              int    `json:"max_series"`
+	MaxSeriesPerFamily     int    `json:"max_series_per_family"`
+	MaxLabelValuesPerLabel int    `json:"max_label_values_per_label"`
+	Policy                 string `json:"policy"`
+}
+
+// WithDefaults fills in any limits not set in l from defaults, so per-tenant
+// overrides only need to mention the limits they change.
+func (l Limits) WithDefaults(defaults Limits) Limits {
+	if l.MaxFamilies == 0 {
+		l.MaxFamilies = defaults.MaxFamilies
+	}
+	if l.MaxSeries == 0 {
+		l.MaxSeries = defaults.MaxSeries
+	}
+	if l.MaxSeriesPerFamily == 0 {
+		l.MaxSeriesPerFamily = defaults.MaxSeriesPerFamily
+	}
+	if l.MaxLabelValuesPerLabel == 0 {
+		l.MaxLabelValuesPerLabel = defaults.MaxLabelValuesPerLabel
+	}
+	if l.Policy == "" {
+		l.Policy = defaults.Policy
+	}
+	return l
+}
+
+// Validate checks the limit policy.
+func (l Limits) Validate() error {
+	switch l.Policy {
+	case "", PolicyReject, PolicyDrop:
+		return nil
+	}
+	return fmt.Errorf("Unknown limit policy %q", l.Policy)
+}
+
+// limitError is returned when a push would exceed one of the limits, and is
+// answered with 429 rather than 400.
+type limitError struct {
+	msg string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+func limitErrorf(format string, args ...interface{}) error {
+	return &limitError{msg: fmt.Sprintf(format, args...)}
+}
+
+// admit checks the series that families would add to the aggregator against its
+// limits.  Depending on the policy, exceeding series either fail the whole
+// push or are removed from families.  On success the series and family counts
+// are updated to include the admitted series.  The families' stored
+// state must be locked, and countsLock held.
+func (a *Aggregator) admit(stored []*storedFamily, names []string, families map[string]*dto.MetricFamily) error {
+	var (
+		newFamilies int
+		newSeries   int
+	)
+	for i, name := range names {
+		family, existing := families[name], stored[i]
+		if existing.series != nil && existing.metricType != family.GetType() && !a.coercesStored(existing, family) {
+			return fmt.Errorf("Cannot merge metric '%s': type %s != %s",
+				name, existing.metricType.String(), family.Type.String())
+		}
+		if existing.series == nil && len(family.Metric) > 0 {
+			if a.limits.MaxFamilies > 0 && a.numFamilies+newFamilies >= a.limits.MaxFamilies {
+				return limitErrorf("Cannot add metric '%s': limit of %d families reached", name, a.limits.MaxFamilies)
+			}
+		}
+
+		familySeries := existing.numSeries
+		values := existing.labelValues
+		var pending map[string]map[string]struct{}
+		if values != nil {
+			pending = map[string]map[string]struct{}{}
+		}
+		kept := family.Metric[:0]
+		for _, m := range family.Metric {
+			if existing.get(labelsFingerprint(m.Label), m.Label) != nil {
+				// Already stored, so doesn't count against any limit.
+				kept = append(kept, m)
+				continue
+			}
+
+			limit, msg := a.exceeded(name, m, a.series+newSeries, familySeries, values, pending)
+			if limit != "" {
+				a.metrics.limited(a.tenant, limit)
+				if a.limits.Policy != PolicyDrop {
+					return limitErrorf("Cannot add series %s: %s", seriesString(name, m), msg)
+				}
+				continue
+			}
+
+			kept = append(kept, m)
+			newSeries++
+			familySeries++
+			if pending == nil {
+				continue
+			}
+			for _, p := range m.Label {
+				if pending[p.GetName()] == nil {
+					pending[p.GetName()] = map[string]struct{}{}
+				}
+				pending[p.GetName()][p.GetValue()] = struct{}{}
+			}
+		}
+		family.Metric = kept
+		if existing.series == nil && len(kept) > 0 {
+			newFamilies++
+		}
+	}
+
+	a.series += newSeries
+	a.numFamilies += newFamilies
+	return nil
+}
+
+// exceeded returns which limit, if any, adding the series m would exceed,
+// along with a description of it.
+func (a *Aggregator) exceeded(name string, m *dto.Metric, series, familySeries int, values map[string]map[string]int, pending map[string]map[string]struct{}) (string, string) {
+	if a.memory.overSoftLimit() {
+		return "memory", fmt.Sprintf("memory soft limit of %d bytes reached", a.memory.soft)
+	}
+	if a.limits.MaxSeries > 0 && series >= a.limits.MaxSeries {
+		return "series", fmt.Sprintf("limit of %d series reached", a.limits.MaxSeries)
+	}
+	if a.limits.MaxSeriesPerFamily > 0 && familySeries >= a.limits.MaxSeriesPerFamily {
+		return "series_per_family", fmt.Sprintf("limit of %d series in metric '%s' reached", a.limits.MaxSeriesPerFamily, name)
+	}
+	if a.limits.MaxLabelValuesPerLabel > 0 {
+		for _, p := range m.Label {
+			if _, ok := values[p.GetName()][p.GetValue()]; ok {
+				continue
+			}
+			if _, ok := pending[p.GetName()][p.GetValue()]; ok {
+				continue
+			}
+			if len(values[p.GetName()])+len(pending[p.GetName()]) >= a.limits.MaxLabelValuesPerLabel {
+				return "label_values", fmt.Sprintf("limit of %d values for label '%s' in metric '%s' reached",
+					a.limits.MaxLabelValuesPerLabel, p.GetName(), name)
+			}
+		}
+	}
+	return "", ""
+}
+
+// seriesString formats a series the same way validateFamily reports it.
+func seriesString(name string, m *dto.Metric) string {
+	lset := make(model.LabelSet, len(m.Label)+1)
+	for _, p := range m.Label {
+		lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
+	}
+	lset[model.MetricNameLabel] = model.LabelValue(name)
+	return lset.String()
+}
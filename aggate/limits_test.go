@@ -0,0 +1,114 @@
+package aggate
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	for _, c := range []struct {
+		limits Limits
+		err    string
+		want   string
+	}{
+		{
+			limits: Limits{MaxSeries: 1},
+			err:    `Cannot add series {__name__="ui_page_render_errors", path="/prom/:orgId"}: limit of 1 series reached`,
+		},
+		{
+			limits: Limits{MaxSeriesPerFamily: 1},
+			err:    `Cannot add series {__name__="ui_page_render_errors", path="/prom/:orgId"}: limit of 1 series in metric 'ui_page_render_errors' reached`,
+		},
+		{
+			limits: Limits{MaxLabelValuesPerLabel: 1},
+			err:    `Cannot add series {__name__="ui_page_render_errors", path="/prom/:orgId"}: limit of 1 values for label 'path' in metric 'ui_page_render_errors' reached`,
+		},
+		{
+			limits: Limits{MaxLabelValuesPerLabel: 1, Policy: PolicyDrop},
+			want: `# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/org/:orgId"} 1
+`,
+		},
+		{
+			limits: Limits{MaxLabelValuesPerLabel: 2},
+			want:   labelFieldResult,
+		},
+	} {
+		a := New(Options{})
+		a.limits = c.limits
+
+		if err := a.Push(strings.NewReader(labelFields1)); err != nil {
+			if c.err == "" {
+				t.Fatalf("Unexpected error: %s", err)
+			} else if _, ok := err.(*limitError); !ok || err.Error() != c.err {
+				t.Fatalf("Expected %s, got %#v", c.err, err)
+			}
+			if a.series != 0 {
+				t.Fatalf("Rejected push should not store series, have %d", a.series)
+			}
+			continue
+		}
+		if err := a.Push(strings.NewReader(labelFields2)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != c.want {
+			t.Fatalf("Expected:\n%s\ngot:\n%s", c.want, have)
+		}
+	}
+}
+
+func TestLimitsAfterRemoval(t *testing.T) {
+	const summary = `# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 1
+rpc_duration_seconds_sum 1
+rpc_duration_seconds_count 1
+`
+	a := New(Options{})
+	a.limits = Limits{MaxFamilies: 1, MaxSeries: 3}
+
+	// Summaries can't be merged, so every other push removes the series,
+	// which must no longer count against the limits.
+	for i := 0; i < 7; i++ {
+		if err := a.Push(strings.NewReader(summary)); err != nil {
+			t.Fatalf("Push %d: unexpected error: %s", i, err)
+		}
+	}
+	if err := a.Push(strings.NewReader(summary)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if families, series := a.Counts(); families != 0 || series != 0 {
+		t.Fatalf("Expected no families or series after removal, have %d and %d", families, series)
+	}
+	if err := a.Push(strings.NewReader(labelFields1)); err != nil {
+		t.Fatalf("Emptied family still counted against the limit: %s", err)
+	}
+}
+
+func TestLabelValuesPruned(t *testing.T) {
+	a := New(Options{})
+	if err := a.Push(strings.NewReader(labelFields1)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if values := a.families["ui_page_render_errors"].labelValues; values != nil {
+		t.Fatalf("Label values should only be tracked with a limit, have %v", values)
+	}
+
+	a = New(Options{})
+	a.limits = Limits{MaxLabelValuesPerLabel: 2}
+	if err := a.Push(strings.NewReader(labelFields1)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sf := a.families["ui_page_render_errors"]
+	for fp, ss := range sf.series {
+		for _, s := range ss {
+			if s.metric.Label[0].GetValue() == "/prom/:orgId" {
+				sf.remove(fp, s)
+			}
+		}
+	}
+	if values := sf.labelValues["path"]; len(values) != 1 || values["/org/:orgId"] != 1 {
+		t.Fatalf("Expected only the remaining value to be tracked, have %v", values)
+	}
+}
@@ -0,0 +1,237 @@
+package aggate
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// evictionTarget is the fraction of the hard limit eviction brings memory
+// usage down to, so that it doesn't run again on the next push.
+const evictionTarget = 0.9
+
+var (
+	memoryUsedDesc = prometheus.NewDesc(
+		"aggate_memory_bytes",
+		"Approximate memory used by stored series, HELP texts and Idempotency-Keys, across all tenants.",
+		nil, nil)
+	memorySoftLimitDesc = prometheus.NewDesc(
+		"aggate_memory_soft_limit_bytes",
+		"Memory usage above which pushes adding series are refused.",
+		nil, nil)
+	memoryHardLimitDesc = prometheus.NewDesc(
+		"aggate_memory_hard_limit_bytes",
+		"Memory usage above which the least recently updated series are evicted.",
+		nil, nil)
+)
+
+// MemoryTracker keeps count of the approximate memory used by the stored
+// series of every Aggregator sharing it, e.g. every tenant.  Above the soft
+// limit, pushes adding series are refused; above the hard limit, series are
+// evicted by Watch.  Zero means unlimited.
+type MemoryTracker struct {
+	soft, hard int64
+	used       int64 // Accessed atomically
+
+	// over is signalled when usage exceeds the hard limit.
+	over    chan struct{}
+	evicted *prometheus.CounterVec // Series evicted, by tenant
+
+	lock        sync.Mutex
+	aggregators []*Aggregator // Those sharing the tracker, to evict from
+}
+
+// NewMemoryTracker returns a tracker with the given limits in bytes.
+func NewMemoryTracker(soft, hard int64) *MemoryTracker {
+	return &MemoryTracker{
+		soft: soft,
+		hard: hard,
+		over: make(chan struct{}, 1),
+		evicted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "aggate_evicted_series_total",
+			Help: "Number of series evicted for exceeding the memory hard limit.",
+		}, []string{"tenant"}),
+	}
+}
+
+// register makes a's series candidates for eviction.
+func (m *MemoryTracker) register(a *Aggregator) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.aggregators = append(m.aggregators, a)
+}
+
+func (m *MemoryTracker) add(bytes int64) {
+	if m == nil {
+		return
+	}
+	if used := atomic.AddInt64(&m.used, bytes); m.hard > 0 && used > m.hard {
+		select {
+		case m.over <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *MemoryTracker) usage() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.used)
+}
+
+// overSoftLimit reports whether new series should be refused.
+func (m *MemoryTracker) overSoftLimit() bool {
+	return m != nil && m.soft > 0 && m.usage() >= m.soft
+}
+
+// Describe implements prometheus.Collector.
+func (m *MemoryTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- memoryUsedDesc
+	ch <- memorySoftLimitDesc
+	ch <- memoryHardLimitDesc
+	m.evicted.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *MemoryTracker) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(memoryUsedDesc, prometheus.GaugeValue, float64(m.usage()))
+	ch <- prometheus.MustNewConstMetric(memorySoftLimitDesc, prometheus.GaugeValue, float64(m.soft))
+	ch <- prometheus.MustNewConstMetric(memoryHardLimitDesc, prometheus.GaugeValue, float64(m.hard))
+	m.evicted.Collect(ch)
+}
+
+// Rough sizes of the structures making up a stored series: a dto.Metric and
+// its storedSeries, a dto.LabelPair with its two strings, and a value or
+// histogram bucket.  Also of the bookkeeping stored alongside: a label
+// value tracked for MaxLabelValuesPerLabel, a HELP variant, and a
+// remembered Idempotency-Key.
+const (
+	seriesOverhead         = 200
+	labelOverhead          = 80
+	valueOverhead          = 32
+	labelValueOverhead     = 64
+	helpOverhead           = 64
+	idempotencyKeyOverhead = 160
+)
+
+// seriesBytes estimates the memory used by a stored series, including its
+// exemplars.  Label strings are counted in full for every series, even
+// though they are interned, which also covers the interner's own entries.
+func seriesBytes(m *dto.Metric) int64 {
+	bytes := seriesOverhead + valueOverhead
+	for _, p := range m.Label {
+		bytes += labelOverhead + len(p.GetName()) + len(p.GetValue())
+	}
+	bytes += exemplarBytes(m.GetCounter().GetExemplar())
+	if h := m.GetHistogram(); h != nil {
+		bytes += valueOverhead * len(h.Bucket)
+		for _, b := range h.Bucket {
+			bytes += exemplarBytes(b.Exemplar)
+		}
+	}
+	if s := m.GetSummary(); s != nil {
+		bytes += valueOverhead * len(s.Quantile)
+	}
+	return int64(bytes)
+}
+
+// Watch evicts series whenever usage exceeds the hard limit.  It never
+// returns.
+func (m *MemoryTracker) Watch() {
+	for range m.over {
+		if n := m.evict(); n > 0 {
+			log.Printf("Evicted %d series to stay under the memory hard limit of %d bytes", n, m.hard)
+		}
+	}
+}
+
+// evictionCandidate is a series which may be evicted.
+type evictionCandidate struct {
+	a       *Aggregator
+	name    string
+	sf      *storedFamily
+	fp      uint64
+	s       *storedSeries
+	updated uint64
+}
+
+// evict removes the least recently updated series of any aggregator until
+// memory usage is back under evictionTarget of the hard limit, and returns
+// how many it removed.
+func (m *MemoryTracker) evict() int {
+	target := int64(float64(m.hard) * evictionTarget)
+	if m.usage() <= target {
+		return 0
+	}
+
+	m.lock.Lock()
+	aggregators := m.aggregators
+	m.lock.Unlock()
+
+	var candidates []evictionCandidate
+	for _, a := range aggregators {
+		names, stored := a.storedFamilies()
+		for i, sf := range stored {
+			sf.lock.Lock()
+			for fp, ss := range sf.series {
+				for _, s := range ss {
+					candidates = append(candidates, evictionCandidate{a: a, name: names[i], sf: sf, fp: fp, s: s, updated: s.updated})
+				}
+			}
+			sf.lock.Unlock()
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].updated < candidates[j].updated })
+
+	evicted := 0
+	for _, c := range candidates {
+		if m.usage() <= target {
+			break
+		}
+		if c.a.evictSeries(c) {
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// evictSeries removes a series, unless it has been updated since it was
+// chosen for eviction.
+func (a *Aggregator) evictSeries(c evictionCandidate) bool {
+	sf := c.sf
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if sf.removed || c.s.updated != c.updated || sf.get(c.fp, c.s.metric.Label) != c.s {
+		return false
+	}
+
+	bytes := sf.bytes
+	sf.remove(c.fp, c.s)
+	sf.changed()
+	a.memory.add(sf.bytes - bytes)
+	a.memory.evicted.WithLabelValues(a.tenant).Inc()
+
+	a.countsLock.Lock()
+	a.series--
+	if sf.numSeries == 0 {
+		a.numFamilies--
+	}
+	a.countsLock.Unlock()
+
+	// Forget the family entirely once it has no series, as unlockFamilies
+	// does.
+	if sf.numSeries == 0 {
+		a.familiesLock.Lock()
+		a.removeFamily(c.name, sf)
+		a.familiesLock.Unlock()
+	}
+	return true
+}
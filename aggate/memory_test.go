@@ -0,0 +1,153 @@
+package aggate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	m := NewMemoryTracker(0, 0)
+	a := New(Options{Memory: m})
+	mux := newTestMux(a)
+	push(mux, "/metrics/", "", "", multilabel1)
+	want := seriesBytes(a.Snapshot()[0].Metric[0]) + helpOverhead + int64(len("A counter"))
+	if have := m.usage(); have != want {
+		t.Fatalf("Expected %d bytes, have %d", want, have)
+	}
+
+	// Updating a series doesn't change its size.
+	push(mux, "/metrics/", "", "", multilabel1)
+	if have := m.usage(); have != want {
+		t.Fatalf("Expected %d bytes, have %d", want, have)
+	}
+}
+
+func TestMemorySoftLimit(t *testing.T) {
+	m := NewMemoryTracker(0, 0)
+	mux := newTestMux(New(Options{Memory: m}))
+	push(mux, "/metrics/", "", "", multilabel1)
+	m.soft = m.usage()
+
+	if w := push(mux, "/metrics/", "", "", gaugeInput); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for a new series, got %d: %s", w.Code, w.Body)
+	} else if !strings.Contains(w.Body.String(), "memory soft limit") {
+		t.Fatalf("Expected the memory limit to be named, got %s", w.Body)
+	}
+	if w := push(mux, "/metrics/", "", "", multilabel1); w.Code != http.StatusOK {
+		t.Fatalf("Expected an existing series to be updated, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestMemoryEviction(t *testing.T) {
+	m := NewMemoryTracker(0, 0)
+	a, b := New(Options{Tenant: "a", Memory: m}), New(Options{Tenant: "b", Memory: m})
+	for _, p := range []struct {
+		a    *Aggregator
+		body string
+	}{
+		{a, "# TYPE c counter\nc{n=\"1\"} 1\n"},
+		{b, "# TYPE c counter\nc{n=\"2\"} 1\n"},
+		{a, "# TYPE g gauge\ng{n=\"3\"} 1\n"},
+		{b, "# TYPE c counter\nc{n=\"2\"} 1\n"}, // Refreshes the second series
+	} {
+		if w := push(p.a.PushHandler(), "/metrics/", "", "", p.body); w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	// Leave room for two of the three series.
+	perSeries := m.usage() / 3
+	m.hard = int64(float64(2*perSeries)/evictionTarget) + 1
+	if n := m.evict(); n != 1 {
+		t.Fatalf("Expected 1 series evicted, got %d", n)
+	}
+
+	if have := m.usage(); have != 2*perSeries {
+		t.Fatalf("Expected %d bytes, have %d", 2*perSeries, have)
+	}
+
+	if have := scrape(a.ScrapeHandler(), "/metrics", "", ""); have != "# TYPE g gauge\ng{n=\"3\"} 1\n" {
+		t.Fatalf("Expected the oldest series to be evicted, got:\n%s", have)
+	}
+	if have := scrape(b.ScrapeHandler(), "/metrics", "", ""); have != "# TYPE c counter\nc{n=\"2\"} 2\n" {
+		t.Fatalf("Expected the refreshed series to be kept, got:\n%s", have)
+	}
+	if a.series != 1 || a.numFamilies != 1 || len(a.families) != 1 {
+		t.Fatalf("Expected one series and family left, have %d, %d, %d", a.series, a.numFamilies, len(a.families))
+	}
+}
+
+func TestMemoryAccountsForEncodedScrapes(t *testing.T) {
+	m := NewMemoryTracker(0, 0)
+	a := New(Options{Memory: m})
+	mux := newTestMux(a)
+	push(mux, "/metrics/", "", "", multilabel1)
+	stored := m.usage()
+
+	// The cached exposition counts until the family changes.
+	body := scrape(mux, "/metrics", "", "")
+	if have, want := m.usage(), stored+int64(len(body)); have != want {
+		t.Fatalf("Expected %d bytes with the scrape cached, have %d", want, have)
+	}
+	scrape(mux, "/metrics", "", "")
+	if have, want := m.usage(), stored+int64(len(body)); have != want {
+		t.Fatalf("Expected a cached scrape to count once, have %d bytes, want %d", have, want)
+	}
+	push(mux, "/metrics/", "", "", multilabel1)
+	if have := m.usage(); have != stored {
+		t.Fatalf("Expected a push to drop the cached scrape, have %d bytes, want %d", have, stored)
+	}
+
+	// Removing the family forgets its cached exposition too.
+	scrape(mux, "/metrics", "", "")
+	m.hard = 1
+	if n := m.evict(); n != 1 {
+		t.Fatalf("Expected 1 series evicted, got %d", n)
+	}
+	if have := m.usage(); have != 0 {
+		t.Fatalf("Expected no bytes left, have %d", have)
+	}
+}
+
+func TestMemoryBookkeeping(t *testing.T) {
+	m := NewMemoryTracker(0, 0)
+	a := New(Options{Memory: m, IdempotencySize: 1, IdempotencyTTL: time.Minute})
+	a.limits = Limits{MaxLabelValuesPerLabel: 2}
+
+	r := httptest.NewRequest("POST", "http://example.com/metrics/", strings.NewReader(labelFields1))
+	r.Header.Set(idempotencyKeyHeader, "key")
+	w := httptest.NewRecorder()
+	a.ServePush(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	var want int64
+	for _, m := range a.Snapshot()[0].Metric {
+		want += seriesBytes(m) + labelValueOverhead
+	}
+	want += helpOverhead + int64(len("A counter"))
+	want += idempotencyKeyOverhead + int64(len("key"))
+	if have := m.usage(); have != want {
+		t.Fatalf("Expected %d bytes, have %d", want, have)
+	}
+
+	// Evicting every series forgets its label values, and the family's
+	// HELP with it.
+	m.hard = 1
+	if n := m.evict(); n != 2 {
+		t.Fatalf("Expected 2 series evicted, got %d", n)
+	}
+	if have, want := m.usage(), int64(idempotencyKeyOverhead+len("key")); have != want {
+		t.Fatalf("Expected only the key's %d bytes left, have %d", want, have)
+	}
+	if err := a.Push(strings.NewReader(labelFields2)); err != nil {
+		t.Fatalf("Evicted label values still counted against the limit: %s", err)
+	}
+	if values := a.families["ui_page_render_errors"].labelValues["path"]; len(values) != 1 {
+		t.Fatalf("Expected only the pushed value to be tracked, have %v", values)
+	}
+}
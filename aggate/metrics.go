@@ -0,0 +1,51 @@
+package aggate
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics counts the pushes and series the Aggregators sharing it refuse,
+// by tenant.  It is a prometheus.Collector, so the embedding program decides
+// where, if anywhere, they are registered.
+type Metrics struct {
+	limitedSeries   *prometheus.CounterVec
+	duplicatePushes *prometheus.CounterVec
+}
+
+// NewMetrics returns a set of zeroed counters.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		limitedSeries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "aggate_limited_series_total",
+			Help: "Number of pushed series rejected or dropped because they exceeded a limit.",
+		}, []string{"tenant", "limit"}),
+		duplicatePushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "aggate_duplicate_pushes_total",
+			Help: "Number of pushes acknowledged without merging because their Idempotency-Key was already seen.",
+		}, []string{"tenant"}),
+	}
+}
+
+func (m *Metrics) limited(tenant, limit string) {
+	if m != nil {
+		m.limitedSeries.WithLabelValues(tenant, limit).Inc()
+	}
+}
+
+func (m *Metrics) duplicate(tenant string) {
+	if m != nil {
+		m.duplicatePushes.WithLabelValues(tenant).Inc()
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.limitedSeries.Describe(ch)
+	m.duplicatePushes.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.limitedSeries.Collect(ch)
+	m.duplicatePushes.Collect(ch)
+}
@@ -0,0 +1,49 @@
+package aggate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m, NewMemoryTracker(0, 0), NewMergeQueue(1, 0))
+
+	for _, tenant := range []string{"a", "b", "a"} {
+		a := New(Options{Tenant: tenant, Limits: Limits{MaxSeries: 1}, Metrics: m})
+		if err := a.Push(strings.NewReader(labelFields1)); err == nil {
+			t.Fatal("Expected the push to exceed the limit")
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "aggate_limited_series_total" {
+			continue
+		}
+		for _, s := range f.Metric {
+			counts[s.Label[1].GetValue()] = s.GetCounter().GetValue()
+		}
+	}
+	if counts["a"] != 2 || counts["b"] != 1 {
+		t.Fatalf("Expected 2 limited series for a and 1 for b, have %v", counts)
+	}
+
+	// Nothing is registered globally, so embedding programs choose.
+	families, err = prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if strings.HasPrefix(f.GetName(), "aggate_") {
+			t.Errorf("Unexpected family %s registered by default", f.GetName())
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package aggate
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var uuidRegex = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// builtinRewrites are the ready-made rewrites available to NormalizeRules,
+// along with their default replacements.
+var builtinRewrites = map[string]struct {
+	replacement string
+	rewrite     func(value, replacement string) string
+}{
+	// UUIDs anywhere in the value.
+	"uuid": {":uuid", func(value, replacement string) string {
+		return uuidRegex.ReplaceAllLiteralString(value, replacement)
+	}},
+	// Path segments consisting only of digits.
+	"numeric": {":id", func(value, replacement string) string {
+		segments := strings.Split(value, "/")
+		for i, s := range segments {
+			if s != "" && strings.Trim(s, "0123456789") == "" {
+				segments[i] = replacement
+			}
+		}
+		return strings.Join(segments, "/")
+	}},
+	// Query string and fragment of a URL.
+	"query_string": {"", func(value, replacement string) string {
+		if i := strings.IndexAny(value, "?#"); i >= 0 {
+			return value[:i] + replacement
+		}
+		return value
+	}},
+}
+
+// NormalizeRule rewrites a label value, either with a builtin rewrite or by
+// replacing every match of a regex.
+type NormalizeRule struct {
+	Builtin     string  `json:"builtin"`
+	Regex       string  `json:"regex"`
+	Replacement *string `json:"replacement"`
+
+	rewrite func(string) string
+}
+
+func (r *NormalizeRule) compile() error {
+	switch {
+	case r.Builtin != "" && r.Regex != "":
+		return fmt.Errorf("Only one of builtin and regex may be given")
+
+	case r.Builtin != "":
+		b, ok := builtinRewrites[r.Builtin]
+		if !ok {
+			return fmt.Errorf("Unknown builtin rewrite %q", r.Builtin)
+		}
+		replacement := b.replacement
+		if r.Replacement != nil {
+			replacement = *r.Replacement
+		}
+		r.rewrite = func(value string) string {
+			return b.rewrite(value, replacement)
+		}
+
+	case r.Regex != "":
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return err
+		}
+		replacement := ""
+		if r.Replacement != nil {
+			replacement = *r.Replacement
+		}
+		r.rewrite = func(value string) string {
+			return re.ReplaceAllString(value, replacement)
+		}
+
+	default:
+		return fmt.Errorf("One of builtin or regex must be given")
+	}
+	return nil
+}
+
+// NormalizeConfig holds, for each label name, the rules to apply in order to
+// its values.  It is typically used to turn URL paths containing real IDs
+// into route templates.
+type NormalizeConfig map[string][]*NormalizeRule
+
+// Compile checks the rules and prepares them for use.
+func (n NormalizeConfig) Compile() error {
+	for name, rules := range n {
+		for i, r := range rules {
+			if err := r.compile(); err != nil {
+				return fmt.Errorf("label %s rule %d: %v", name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// transform normalizes label values in every series.  Series which collide
+// once normalized are merged.
+func (n NormalizeConfig) transform(families map[string]*dto.MetricFamily) error {
+	if len(n) == 0 {
+		return nil
+	}
+	for _, family := range families {
+		changed := false
+		for _, m := range family.Metric {
+			for _, p := range m.Label {
+				rules, ok := n[p.GetName()]
+				if !ok {
+					continue
+				}
+				value := p.GetValue()
+				for _, r := range rules {
+					value = r.rewrite(value)
+				}
+				if value != p.GetValue() {
+					p.Value = &value
+					changed = true
+				}
+			}
+		}
+		if changed {
+			// mergeDuplicates needs labels sorted by name, which normally
+			// only happens afterwards.
+			for _, m := range family.Metric {
+				sort.Sort(ByName(m.Label))
+			}
+			if err := mergeDuplicates(family); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package aggate
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	var n NormalizeConfig
+	if err := json.Unmarshal([]byte(`{
+  "path": [
+    {"builtin": "query_string"},
+    {"builtin": "uuid", "replacement": ":orgId"},
+    {"builtin": "numeric", "replacement": ":orgId"},
+    {"regex": "^/organisation/", "replacement": "/org/"}
+  ]
+}`), &n); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New(Options{})
+	a.normalize = n
+	in1 := `# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/org/1234"} 1
+ui_page_render_errors{path="/prom/5678?tab=graph#top"} 1
+`
+	in2 := `# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/prom/ed4b2b5c-0c16-4bbd-8d4a-21ff3c3b2b70"} 1
+`
+	for _, in := range []string{in1, in2} {
+		if err := a.Push(strings.NewReader(in)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != labelFieldResult {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", labelFieldResult, have)
+	}
+
+	// Series colliding after normalization are merged rather than
+	// rejected as duplicates.
+	a = New(Options{})
+	a.normalize = n
+	collide := `# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/organisation/1"} 1
+ui_page_render_errors{path="/org/2"} 1
+ui_page_render_errors{path="/prom/3"} 2
+`
+	if err := a.Push(strings.NewReader(collide)); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/org/:orgId"} 2
+ui_page_render_errors{path="/prom/:orgId"} 2
+`
+	if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+
+	// Summaries can't be merged, so colliding ones are refused rather than
+	// silently dropped.
+	summaries := `# TYPE s summary
+s{path="/org/1",quantile="0.5"} 1
+s_sum{path="/org/1"} 1
+s_count{path="/org/1"} 1
+s{path="/org/2",quantile="0.5"} 2
+s_sum{path="/org/2"} 2
+s_count{path="/org/2"} 1
+`
+	w := push(a.PushHandler(), "/metrics/", "", "", summaries)
+	if want := `Several series of summary became {__name__="s", path="/org/:orgId"}`; w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("Expected 400 with %q, got %d: %s", want, w.Code, w.Body)
+	}
+}
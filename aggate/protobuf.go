@@ -0,0 +1,163 @@
+package aggate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// parseProtobuf parses a push of length-delimited MetricFamily messages, as
+// client_golang's push package sends, failing as soon as it exceeds any of
+// the limits.
+func (l PushLimits) parseProtobuf(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	lr := &io.LimitedReader{R: r, N: math.MaxInt64}
+	if l.MaxBytes > 0 {
+		lr.N = l.MaxBytes + 1
+	}
+	br := bufio.NewReader(lr)
+	families := map[string]*dto.MetricFamily{}
+	series := 0
+	for {
+		f := &dto.MetricFamily{}
+		err := readDelimited(br, f)
+		if lr.N == 0 {
+			return nil, &pushLimitError{msg: fmt.Sprintf("Push larger than %d bytes", l.MaxBytes), tooLarge: true}
+		}
+		if err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := checkProtobufFamily(f); err != nil {
+			return nil, err
+		}
+		if _, ok := families[f.GetName()]; ok {
+			return nil, fmt.Errorf("Metric family '%s' pushed more than once", f.GetName())
+		}
+		families[f.GetName()] = f
+		series += len(f.Metric)
+		if err := l.checkProtobuf(f, len(families), series); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readDelimited reads a message prefixed with its varint length.  The
+// message is buffered as it arrives, so a client can't make us allocate
+// more than it sends by claiming a huge length.
+func readDelimited(r *bufio.Reader, m proto.Message) error {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if length > math.MaxInt32 {
+		return fmt.Errorf("Protobuf message longer than %d bytes", math.MaxInt32)
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	return proto.Unmarshal(buf.Bytes(), m)
+}
+
+// checkProtobuf checks a decoded family against the limits, given the
+// number of families and series pushed so far.
+func (l PushLimits) checkProtobuf(f *dto.MetricFamily, families, series int) error {
+	if l.MaxFamilies > 0 && families > l.MaxFamilies {
+		return pushLimitErrorf("Push has more than %d metric families", l.MaxFamilies)
+	}
+	if l.MaxSeries > 0 && series > l.MaxSeries {
+		return pushLimitErrorf("Push has more than %d series", l.MaxSeries)
+	}
+	if err := l.checkName("metric", f.GetName()); err != nil {
+		return err
+	}
+	for _, m := range f.Metric {
+		if l.MaxLabels > 0 && len(m.Label) > l.MaxLabels {
+			return pushLimitErrorf("Series of metric '%s' has more than %d labels", f.GetName(), l.MaxLabels)
+		}
+		for _, p := range m.Label {
+			if err := l.checkName("label", p.GetName()); err != nil {
+				return err
+			}
+			if l.MaxValueLength > 0 && len(p.GetValue()) > l.MaxValueLength {
+				return pushLimitErrorf("Series of metric '%s' has a label value longer than %d bytes", f.GetName(), l.MaxValueLength)
+			}
+		}
+	}
+	return nil
+}
+
+// checkProtobufFamily checks that a decoded family has everything the text
+// parser would have filled in: a valid name, and labels and values for
+// every series.
+func checkProtobufFamily(f *dto.MetricFamily) error {
+	name := f.GetName()
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("Invalid metric name %q", name)
+	}
+	if f.Type == nil {
+		return fmt.Errorf("Metric family '%s' has no type", name)
+	}
+	for _, m := range f.Metric {
+		if m == nil {
+			return fmt.Errorf("Metric family '%s' has an empty series", name)
+		}
+		for _, p := range m.Label {
+			if p == nil || p.Name == nil || p.Value == nil {
+				return fmt.Errorf("Series of metric '%s' has an incomplete label", name)
+			}
+		}
+		if !hasValue(f.GetType(), m) {
+			return fmt.Errorf("Series of metric '%s' has no %s value", name, strings.ToLower(f.GetType().String()))
+		}
+	}
+	return nil
+}
+
+// hasValue reports whether m has every field merging a sample of type ty
+// reads.
+func hasValue(ty dto.MetricType, m *dto.Metric) bool {
+	switch ty {
+	case dto.MetricType_COUNTER:
+		return m.Counter != nil && m.Counter.Value != nil
+	case dto.MetricType_GAUGE:
+		return m.Gauge != nil && m.Gauge.Value != nil
+	case dto.MetricType_UNTYPED:
+		return m.Untyped != nil && m.Untyped.Value != nil
+	case dto.MetricType_SUMMARY:
+		s := m.Summary
+		if s == nil || s.SampleCount == nil || s.SampleSum == nil {
+			return false
+		}
+		for _, q := range s.Quantile {
+			if q == nil || q.Quantile == nil || q.Value == nil {
+				return false
+			}
+		}
+		return true
+	case dto.MetricType_HISTOGRAM:
+		h := m.Histogram
+		if h == nil || h.SampleCount == nil || h.SampleSum == nil {
+			return false
+		}
+		for _, b := range h.Bucket {
+			if b == nil || b.UpperBound == nil || b.CumulativeCount == nil {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package aggate
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// protobufPush encodes families as a delimited protobuf push.
+func protobufPush(t *testing.T, families ...*dto.MetricFamily) string {
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, f := range families {
+		if err := enc.Encode(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+// parseText parses a push in the text format into its families, sorted by
+// name.
+func parseText(t *testing.T, text string) []*dto.MetricFamily {
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := make([]*dto.MetricFamily, 0, len(parsed))
+	for _, f := range parsed {
+		families = append(families, f)
+	}
+	sort.Sort(ByFamilyName(families))
+	return families
+}
+
+func pushProtobuf(h http.Handler, body string) *httptest.ResponseRecorder {
+	return push(h, "/metrics/", "Content-Type", string(expfmt.FmtProtoDelim), body)
+}
+
+func TestProtobufPush(t *testing.T) {
+	a := New(Options{})
+	mux := newTestMux(a)
+	if w := pushProtobuf(mux, protobufPush(t, parseText(t, in1)...)); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+	if w := push(mux, "/metrics/", "", "", in2); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+	if have := scrape(mux, "/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+}
+
+func TestProtobufPushRejected(t *testing.T) {
+	counter := dto.MetricType_COUNTER
+	for _, c := range []struct {
+		name   string
+		limits PushLimits
+		in     string
+		code   int
+		err    string
+	}{
+		{
+			name:   "body",
+			limits: PushLimits{MaxBytes: 100},
+			in:     protobufPush(t, parseText(t, in1)...),
+			code:   http.StatusRequestEntityTooLarge,
+			err:    "Push larger than 100 bytes",
+		},
+		{
+			name:   "series",
+			limits: PushLimits{MaxSeries: 1},
+			in:     protobufPush(t, parseText(t, labelFields1)...),
+			code:   http.StatusBadRequest,
+			err:    "Push has more than 1 series",
+		},
+		{
+			name:   "value length",
+			limits: PushLimits{MaxValueLength: 2},
+			in:     protobufPush(t, parseText(t, labelFields1)...),
+			code:   http.StatusBadRequest,
+			err:    "Series of metric 'ui_page_render_errors' has a label value longer than 2 bytes",
+		},
+		{
+			name: "missing value",
+			in: protobufPush(t, &dto.MetricFamily{
+				Name:   proto.String("requests_total"),
+				Type:   &counter,
+				Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+			}),
+			code: http.StatusBadRequest,
+			err:  "Series of metric 'requests_total' has no counter value",
+		},
+		{
+			name: "family twice",
+			in:   protobufPush(t, parseText(t, in1)[0], parseText(t, in1)[0]),
+			code: http.StatusBadRequest,
+			err:  "pushed more than once",
+		},
+		{
+			name: "truncated",
+			in:   protobufPush(t, parseText(t, in1)...)[:20],
+			code: http.StatusBadRequest,
+			err:  "unexpected EOF",
+		},
+		{
+			name: "length larger than the push",
+			in:   "\xff\xff\xff\xff\x07",
+			code: http.StatusBadRequest,
+			err:  "unexpected EOF",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a := New(Options{PushLimits: c.limits})
+			w := pushProtobuf(a.PushHandler(), c.in)
+			if w.Code != c.code {
+				t.Fatalf("Expected status %d, got %d: %s", c.code, w.Code, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), c.err) {
+				t.Fatalf("Expected error containing %q, got %q", c.err, w.Body)
+			}
+			if families, series := a.Counts(); families != 0 || series != 0 {
+				t.Fatalf("Rejected push stored %d families and %d series", families, series)
+			}
+		})
+	}
+}
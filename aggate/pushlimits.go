@@ -0,0 +1,355 @@
+package aggate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// PushLimits bounds the size of a single push.  They are checked as the push
+// is read, before it is held in memory as a whole.  Zero means unlimited.
+type PushLimits struct {
+	MaxBytes       int64
+	MaxFamilies    int
+	MaxSeries      int
+	MaxLabels      int // Per series
+	MaxNameLength  int // Of metric and label names
+	MaxValueLength int // Of label values
+}
+
+// pushLimitError is returned for a push exceeding one of the PushLimits.
+// It is answered with 413 if the push is too large, and 400 otherwise.
+type pushLimitError struct {
+	msg      string
+	tooLarge bool
+}
+
+func (e *pushLimitError) Error() string {
+	return e.msg
+}
+
+func pushLimitErrorf(format string, args ...interface{}) error {
+	return &pushLimitError{msg: fmt.Sprintf(format, args...)}
+}
+
+// parse parses a push in format, failing as soon as it exceeds any of the
+// limits.  Anything but delimited protobuf is parsed as text.
+func (l PushLimits) parse(r io.Reader, format expfmt.Format) (map[string]*dto.MetricFamily, error) {
+	if format == expfmt.FmtProtoDelim {
+		return l.parseProtobuf(r)
+	}
+	var parser expfmt.TextParser
+	if l == (PushLimits{}) {
+		return parser.TextToMetricFamilies(r)
+	}
+	lr := &pushLimitReader{r: r, limits: l, families: map[string]struct{}{}, types: map[string]string{}, series: map[string]struct{}{}}
+	families, err := parser.TextToMetricFamilies(lr)
+	// The parser takes a read error at the start of a line for the end of
+	// the push, so check for one here.
+	if lr.err != nil {
+		return nil, lr.err
+	}
+	return families, err
+}
+
+// pushLimitReader checks each line of a push in the text format as the
+// parser reads it.  Lines it can't make sense of are passed on for the
+// parser to reject.
+type pushLimitReader struct {
+	r      io.Reader
+	limits PushLimits
+	err    error
+
+	read     int64
+	line     []byte // The incomplete last line read so far
+	checkAt  int    // Length of line at which to check it while incomplete
+	skipping bool   // Whether the rest of the line is to be ignored
+	families map[string]struct{}
+	types    map[string]string   // Family -> declared type
+	series   map[string]struct{} // Series seen, when MaxSeries is set
+}
+
+func (p *pushLimitReader) Read(buf []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n, err := p.r.Read(buf)
+	p.read += int64(n)
+	if p.limits.MaxBytes > 0 && p.read > p.limits.MaxBytes {
+		p.err = &pushLimitError{msg: fmt.Sprintf("Push larger than %d bytes", p.limits.MaxBytes), tooLarge: true}
+		return 0, p.err
+	}
+
+	data := buf[:n]
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		if !p.skipping {
+			p.line = append(p.line, data[:i]...)
+			if p.err = p.checkLine(string(p.line)); p.err != nil {
+				return 0, p.err
+			}
+		}
+		p.line, p.checkAt, p.skipping = p.line[:0], 0, false
+		data = data[i+1:]
+	}
+	if !p.skipping {
+		p.line = append(p.line, data...)
+	}
+
+	if err == io.EOF && len(p.line) > 0 {
+		if p.err = p.checkLine(string(p.line)); p.err != nil {
+			return 0, p.err
+		}
+		p.line = p.line[:0]
+	} else if p.err = p.checkLongLine(); p.err != nil {
+		return 0, p.err
+	}
+	return n, err
+}
+
+// minPartialCheck is the length from which incomplete lines are checked as
+// they arrive.
+const minPartialCheck = 4096
+
+// checkLongLine checks the incomplete line read so far against the name and
+// label limits each time its length doubles, so a client can't make us
+// buffer an arbitrarily long line.  Once the line holds everything
+// checkLine reads, it is checked in full and the rest of it is ignored.
+func (p *pushLimitReader) checkLongLine() error {
+	if len(p.line) < minPartialCheck || len(p.line) < p.checkAt {
+		return nil
+	}
+	// Whitespace at the start of a line, or of a comment, doesn't change
+	// what checkLine makes of it.
+	switch t := bytes.TrimSpace(p.line); {
+	case len(t) == 0:
+		p.line, p.checkAt = p.line[:0], 0
+		return nil
+	case len(t) == 1 && t[0] == '#':
+		p.line, p.checkAt = append(p.line[:0], "# "...), 0
+		return nil
+	}
+
+	p.checkAt = 2 * len(p.line)
+	complete, err := p.checkPartialLine(string(p.line))
+	if err != nil || !complete {
+		return err
+	}
+	if err := p.checkLine(string(p.line)); err != nil {
+		return err
+	}
+	p.line, p.skipping = p.line[:0], true
+	return nil
+}
+
+// checkPartialLine checks an incomplete line against the name and label
+// limits, and reports whether it already holds everything checkLine reads:
+// the type of a TYPE line, the family name of any other comment, or the
+// labels of a sample.
+func (p *pushLimitReader) checkPartialLine(line string) (bool, error) {
+	line = strings.TrimLeft(line, " \t")
+	if line[0] == '#' {
+		fields := strings.Fields(line[1:])
+		complete := len(fields)
+		if !strings.ContainsAny(line[len(line)-1:], " \t") {
+			complete--
+		}
+		switch {
+		case fields[0] != "HELP" && fields[0] != "TYPE":
+			return complete >= 1, nil
+		case len(fields) < 2:
+			return false, nil
+		}
+		if err := p.limits.checkName("metric", fields[1]); err != nil {
+			return false, err
+		}
+		if fields[0] == "TYPE" {
+			return complete >= 3, nil
+		}
+		return complete >= 2, nil
+	}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return false, p.limits.checkName("metric", line)
+	}
+	name := line[:end]
+	if err := p.limits.checkName("metric", name); err != nil {
+		return false, err
+	}
+	if line[end] != '{' {
+		return true, nil
+	}
+	_, closed, err := p.checkLabels(name, line[end+1:])
+	return closed, err
+}
+
+func (p *pushLimitReader) checkLine(line string) error {
+	line = strings.TrimLeft(line, " \t")
+	if line == "" {
+		return nil
+	}
+	if line[0] == '#' {
+		fields := strings.Fields(line[1:])
+		if len(fields) < 2 || (fields[0] != "HELP" && fields[0] != "TYPE") {
+			return nil
+		}
+		if err := p.limits.checkName("metric", fields[1]); err != nil {
+			return err
+		}
+		if len(fields) > 2 && fields[0] == "TYPE" {
+			p.types[fields[1]] = fields[2]
+		}
+		return p.checkFamily(fields[1])
+	}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		end = len(line)
+	}
+	name := line[:end]
+	if err := p.limits.checkName("metric", name); err != nil {
+		return err
+	}
+	family := p.familyName(name)
+	if err := p.checkFamily(family); err != nil {
+		return err
+	}
+	var labels []string
+	if end < len(line) && line[end] == '{' {
+		var err error
+		if labels, _, err = p.checkLabels(name, line[end+1:]); err != nil {
+			return err
+		}
+	}
+	return p.checkSeries(family, labels)
+}
+
+// checkSeries counts the series a sample of family with labels belongs to.
+// Each histogram or summary series has several samples, from its _bucket,
+// _sum and _count lines, which differ only in their le or quantile label.
+func (p *pushLimitReader) checkSeries(family string, labels []string) error {
+	if p.limits.MaxSeries == 0 {
+		return nil
+	}
+	var skip string
+	switch p.types[family] {
+	case "histogram":
+		skip = model.BucketLabel
+	case "summary":
+		skip = model.QuantileLabel
+	}
+	kept := labels[:0]
+	for _, l := range labels {
+		if skip == "" || !strings.HasPrefix(l, skip+"=") {
+			kept = append(kept, l)
+		}
+	}
+	// Clients needn't send labels in the same order on every line.
+	sort.Strings(kept)
+	key := family + "{" + strings.Join(kept, ",") + "}"
+	if _, ok := p.series[key]; ok {
+		return nil
+	}
+	p.series[key] = struct{}{}
+	if len(p.series) > p.limits.MaxSeries {
+		return pushLimitErrorf("Push has more than %d series", p.limits.MaxSeries)
+	}
+	return nil
+}
+
+// familyName returns the family a sample belongs to, which for histograms
+// and summaries is its name without the suffix.
+func (p *pushLimitReader) familyName(name string) string {
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base == name {
+			continue
+		}
+		if ty := p.types[base]; ty == "histogram" || (ty == "summary" && suffix != "_bucket") {
+			return base
+		}
+	}
+	return name
+}
+
+func (p *pushLimitReader) checkFamily(name string) error {
+	if _, ok := p.families[name]; ok || p.limits.MaxFamilies == 0 {
+		return nil
+	}
+	p.families[name] = struct{}{}
+	if len(p.families) > p.limits.MaxFamilies {
+		return pushLimitErrorf("Push has more than %d metric families", p.limits.MaxFamilies)
+	}
+	return nil
+}
+
+func (l PushLimits) checkName(kind, name string) error {
+	if l.MaxNameLength > 0 && len(name) > l.MaxNameLength {
+		return pushLimitErrorf("Push has a %s name longer than %d bytes: %.32q...", kind, l.MaxNameLength, name)
+	}
+	return nil
+}
+
+// checkLabels checks the labels of a series, given the rest of its line
+// after the opening brace, and returns them as name="value" with the value
+// still escaped.  It also reports whether it found the closing brace, so
+// may be given an incomplete line.
+func (p *pushLimitReader) checkLabels(metric, s string) ([]string, bool, error) {
+	var labels []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" || s[0] == '}' {
+			return labels, s != "", nil
+		}
+		if p.limits.MaxLabels > 0 && len(labels) >= p.limits.MaxLabels {
+			return nil, false, pushLimitErrorf("Series of metric '%s' has more than %d labels", metric, p.limits.MaxLabels)
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			// Either the line is malformed, or the name is still arriving.
+			if end := strings.IndexAny(s, "}, \t\""); end >= 0 {
+				s = s[:end]
+			}
+			return labels, false, p.limits.checkName("label", s)
+		}
+		name := strings.TrimRight(s[:eq], " \t")
+		if err := p.limits.checkName("label", name); err != nil {
+			return nil, false, err
+		}
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if s == "" || s[0] != '"' {
+			return labels, false, nil
+		}
+
+		// Find the closing quote, skipping escaped characters.
+		length, i := 0, 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' {
+				i++
+			}
+			length++
+		}
+		if p.limits.MaxValueLength > 0 && length > p.limits.MaxValueLength {
+			return nil, false, pushLimitErrorf("Series of metric '%s' has a label value longer than %d bytes", metric, p.limits.MaxValueLength)
+		}
+		if i >= len(s) {
+			return labels, false, nil
+		}
+		labels = append(labels, name+"="+s[:i+1])
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if s != "" && s[0] == ',' {
+			s = s[1:]
+		}
+	}
+}
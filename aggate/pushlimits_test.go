@@ -0,0 +1,195 @@
+package aggate
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPushLimits(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		limits PushLimits
+		in     string
+		code   int
+		err    string
+	}{
+		{
+			name:   "within every limit",
+			limits: PushLimits{MaxBytes: 1 << 20, MaxFamilies: 4, MaxSeries: 4, MaxLabels: 2, MaxNameLength: 16, MaxValueLength: 6},
+			in:     in1 + "escaped{a=\"x,y=\\\"}\",b=\"\"} 1\n",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "body",
+			limits: PushLimits{MaxBytes: 100},
+			in:     in1,
+			code:   http.StatusRequestEntityTooLarge,
+			err:    "Push larger than 100 bytes",
+		},
+		{
+			name:   "families",
+			limits: PushLimits{MaxFamilies: 2},
+			in:     in1,
+			code:   http.StatusBadRequest,
+			err:    "Push has more than 2 metric families",
+		},
+		{
+			name:   "series",
+			limits: PushLimits{MaxSeries: 1},
+			in:     labelFields1,
+			code:   http.StatusBadRequest,
+			err:    "Push has more than 1 series",
+		},
+		{
+			name:   "histogram and summary series",
+			limits: PushLimits{MaxSeries: 2},
+			in: `# TYPE h histogram
+h_bucket{a="1",le="1"} 1
+h_bucket{le="+Inf",a="1"} 1
+h_sum{a="1"} 1
+h_count{a="1"} 1
+# TYPE s summary
+s{a="1",quantile="0.5"} 1
+s{a="1",quantile="0.9"} 1
+s_sum{a="1"} 1
+s_count{a="1"} 1
+`,
+			code: http.StatusOK,
+		},
+		{
+			name:   "histogram buckets without count",
+			limits: PushLimits{MaxSeries: 2},
+			in: `# TYPE h histogram
+h_bucket{a="1",le="+Inf"} 1
+h_bucket{a="2",le="+Inf"} 1
+h_bucket{a="3",le="+Inf"} 1
+`,
+			code: http.StatusBadRequest,
+			err:  "Push has more than 2 series",
+		},
+		{
+			name:   "summary sums without count",
+			limits: PushLimits{MaxSeries: 2},
+			in: `# TYPE s summary
+s_sum{a="1"} 1
+s_sum{a="2"} 1
+s_sum{a="3"} 1
+`,
+			code: http.StatusBadRequest,
+			err:  "Push has more than 2 series",
+		},
+		{
+			name:   "labels",
+			limits: PushLimits{MaxLabels: 1},
+			in:     multilabel1,
+			code:   http.StatusBadRequest,
+			err:    "Series of metric 'counter' has more than 1 labels",
+		},
+		{
+			name:   "metric name",
+			limits: PushLimits{MaxNameLength: 6},
+			in:     "a_long_name 1",
+			code:   http.StatusBadRequest,
+			err:    `Push has a metric name longer than 6 bytes: "a_long_name"...`,
+		},
+		{
+			name:   "label name",
+			limits: PushLimits{MaxNameLength: 6},
+			in:     "metric{a_long_name=\"x\"} 1\n",
+			code:   http.StatusBadRequest,
+			err:    `Push has a label name longer than 6 bytes: "a_long_name"...`,
+		},
+		{
+			name:   "label value",
+			limits: PushLimits{MaxValueLength: 3},
+			in:     "metric{a=\"abcd\"} 1\n",
+			code:   http.StatusBadRequest,
+			err:    "Series of metric 'metric' has a label value longer than 3 bytes",
+		},
+	} {
+		w := push(New(Options{PushLimits: c.limits}).PushHandler(), "/metrics/", "", "", c.in)
+		if w.Code != c.code {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.code, w.Code, w.Body)
+		}
+		if have := strings.TrimSpace(w.Body.String()); have != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, have)
+		}
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	n, err := c.r.Read(buf)
+	c.read += n
+	return n, err
+}
+
+func TestPushLimitsLongLines(t *testing.T) {
+	long := strings.Repeat("x", 1<<24)
+	for _, c := range []struct {
+		name   string
+		limits PushLimits
+		in     string
+		err    string
+	}{
+		{
+			name:   "metric name",
+			limits: PushLimits{MaxNameLength: 16},
+			in:     long,
+			err:    `Push has a metric name longer than 16 bytes: "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"...`,
+		},
+		{
+			name:   "family name",
+			limits: PushLimits{MaxNameLength: 16},
+			in:     "# TYPE " + long,
+			err:    `Push has a metric name longer than 16 bytes: "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"...`,
+		},
+		{
+			name:   "label name",
+			limits: PushLimits{MaxNameLength: 16},
+			in:     "metric{" + long,
+			err:    `Push has a label name longer than 16 bytes: "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"...`,
+		},
+		{
+			name:   "label value",
+			limits: PushLimits{MaxValueLength: 16},
+			in:     `metric{a="` + long,
+			err:    "Series of metric 'metric' has a label value longer than 16 bytes",
+		},
+	} {
+		r := &countingReader{r: strings.NewReader(c.in)}
+		_, err := c.limits.parse(r, expfmt.FmtText)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected error %q, got %v", c.name, c.err, err)
+		}
+		if r.read > 1<<20 {
+			t.Errorf("%s: read %d bytes before refusing the push", c.name, r.read)
+		}
+	}
+
+	// Lines within the limits are read in full, but only as much of them is
+	// kept as is checked.
+	for _, in := range []string{
+		"# HELP metric " + long + "\nmetric 1\n",
+		"metric{a=\"b\"} 1 " + long + "\n",
+		strings.Repeat(" ", 1<<24) + "\nmetric 1\n",
+	} {
+		lr := &pushLimitReader{r: strings.NewReader(in), limits: PushLimits{MaxNameLength: 16}, families: map[string]struct{}{}, types: map[string]string{}, series: map[string]struct{}{}}
+		if _, err := io.Copy(ioutil.Discard, lr); err != nil {
+			t.Fatalf("%.20q: %v", in, err)
+		}
+		if cap(lr.line) > 1<<20 {
+			t.Errorf("%.20q: kept %d bytes of a line", in, cap(lr.line))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package aggate
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// queueRetryAfter is the Retry-After, in seconds, sent with pushes refused
+// because the merge queue is full.
+const queueRetryAfter = "1"
+
+var (
+	queueDepthDesc = prometheus.NewDesc(
+		"aggate_merge_queue_depth",
+		"Number of parsed pushes waiting to be merged.",
+		nil, nil)
+	queueCapacityDesc = prometheus.NewDesc(
+		"aggate_merge_queue_capacity",
+		"Maximum number of parsed pushes that can wait to be merged.",
+		nil, nil)
+)
+
+// errQueueFull is returned for pushes that can't be queued, and is answered
+// with 503.
+var errQueueFull = fmt.Errorf("Too many pushes waiting to be merged")
+
+// MergeQueue merges parsed pushes in the background, so push latency is
+// only that of parsing them.
+type MergeQueue struct {
+	jobs chan mergeJob
+
+	droppedPushes *prometheus.CounterVec // Refused as the queue was full, by tenant
+	mergeErrors   *prometheus.CounterVec // Failed to merge, by tenant
+}
+
+type mergeJob struct {
+	a    *Aggregator
+	push *parsedPush
+	key  string // Reserved Idempotency-Key, if any
+}
+
+// NewMergeQueue returns a queue holding up to size pushes, merged by the
+// given number of workers.
+func NewMergeQueue(size, workers int) *MergeQueue {
+	q := &MergeQueue{
+		jobs: make(chan mergeJob, size),
+		droppedPushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "aggate_merge_queue_dropped_pushes_total",
+			Help: "Number of pushes refused with 503 because the merge queue was full.",
+		}, []string{"tenant"}),
+		mergeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "aggate_merge_queue_errors_total",
+			Help: "Number of queued pushes that failed to merge, e.g. for exceeding a limit.",
+		}, []string{"tenant"}),
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *MergeQueue) work() {
+	for job := range q.jobs {
+		err := job.a.merge(job.push)
+		job.a.finishKey(job.key, err)
+		if err != nil {
+			q.mergeErrors.WithLabelValues(job.a.tenant).Inc()
+			log.Printf("Error merging queued push for tenant %q: %v", job.a.tenant, err)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (q *MergeQueue) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueCapacityDesc
+	q.droppedPushes.Describe(ch)
+	q.mergeErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (q *MergeQueue) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(len(q.jobs)))
+	ch <- prometheus.MustNewConstMetric(queueCapacityDesc, prometheus.GaugeValue, float64(cap(q.jobs)))
+	q.droppedPushes.Collect(ch)
+	q.mergeErrors.Collect(ch)
+}
+
+// pushQueued parses and validates a push, and queues it to be merged.
+// Errors found while merging, such as exceeded limits, are only logged and
+// counted, as the client has already been answered.
+func (a *Aggregator) pushQueued(key string, r io.Reader, format expfmt.Format, transforms ...Transform) error {
+	key, err := a.reserveKey(key)
+	if err != nil {
+		return err
+	}
+	p, err := a.parse(r, format, transforms...)
+	if err != nil {
+		a.finishKey(key, err)
+		return err
+	}
+
+	select {
+	case a.queue.jobs <- mergeJob{a: a, push: p, key: key}:
+		return nil
+	default:
+		a.finishKey(key, errQueueFull)
+		a.queue.droppedPushes.WithLabelValues(a.tenant).Inc()
+		return errQueueFull
+	}
+}
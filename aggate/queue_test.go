@@ -0,0 +1,63 @@
+package aggate
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestMergeQueue(t *testing.T) {
+	mux := newTestMux(New(Options{Queue: NewMergeQueue(10, 1)}))
+
+	for i := 0; i < 2; i++ {
+		if w := push(mux, "/metrics/", "", "", multilabel1); w.Code != http.StatusAccepted {
+			t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	want := `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b"} 2
+`
+	var have string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if have = scrape(mux, "/metrics", "", ""); have == want {
+			return
+		}
+	}
+	t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+}
+
+func TestMergeQueueFull(t *testing.T) {
+	a := New(Options{Queue: NewMergeQueue(1, 0)}) // Nothing merges, so the queue fills
+	mux := newTestMux(a)
+
+	if w := push(mux, "/metrics/", "", "", multilabel1); w.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+	w := push(mux, "/metrics/", "", "", multilabel1)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != queueRetryAfter {
+		t.Fatalf("Expected 503 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+
+	// Invalid pushes are still refused synchronously.
+	if w := push(mux, "/metrics/", "", "", "not metrics"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d: %s", w.Code, w.Body)
+	}
+	if depth := len(a.queue.jobs); depth != 1 {
+		t.Fatalf("Expected queue depth 1, have %d", depth)
+	}
+}
+
+func TestMergeQueueFullReleasesKey(t *testing.T) {
+	a := New(Options{Queue: NewMergeQueue(0, 0), IdempotencySize: 10, IdempotencyTTL: time.Minute})
+	if err := a.pushQueued("key", strings.NewReader(multilabel1), expfmt.FmtText); err != errQueueFull {
+		t.Fatalf("Expected errQueueFull, got %v", err)
+	}
+	if err := a.idempotency.reserve("key"); err != nil {
+		t.Fatalf("Expected the key to be released for a retry, got %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package aggate
+
+import (
+	"crypto/md5"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelHashMod   = "hashmod"
+	relabelLabelMap  = "labelmap"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+	relabelLowercase = "lowercase"
+)
+
+// RelabelConfig is a Prometheus-compatible relabeling rule, applied to
+// every pushed series.  The metric name is available as __name__.
+type RelabelConfig struct {
+	SourceLabels []string `json:"source_labels"`
+	Separator    *string  `json:"separator"`
+	Regex        *string  `json:"regex"`
+	Modulus      uint64   `json:"modulus"`
+	TargetLabel  string   `json:"target_label"`
+	Replacement  *string  `json:"replacement"`
+	Action       string   `json:"action"`
+
+	regex *regexp.Regexp
+}
+
+// compile fills in Prometheus' defaults and checks the rule.
+func (c *RelabelConfig) compile() error {
+	if c.Action == "" {
+		c.Action = relabelReplace
+	}
+	if c.Separator == nil {
+		separator := ";"
+		c.Separator = &separator
+	}
+	if c.Regex == nil {
+		regex := "(.*)"
+		c.Regex = &regex
+	}
+	if c.Replacement == nil {
+		replacement := "$1"
+		c.Replacement = &replacement
+	}
+
+	re, err := regexp.Compile("^(?:" + *c.Regex + ")$")
+	if err != nil {
+		return err
+	}
+	c.regex = re
+
+	switch c.Action {
+	case relabelReplace, relabelLowercase, relabelHashMod:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires target_label", c.Action)
+		}
+		if c.Action == relabelHashMod && c.Modulus == 0 {
+			return fmt.Errorf("relabel action %s requires a non-zero modulus", c.Action)
+		}
+	case relabelKeep, relabelDrop, relabelLabelMap, relabelLabelDrop, relabelLabelKeep:
+	default:
+		return fmt.Errorf("Unknown relabel action %q", c.Action)
+	}
+	return nil
+}
+
+// CompileRelabelConfigs checks the rules and prepares them for use.
+func CompileRelabelConfigs(cfgs []*RelabelConfig) error {
+	for i, c := range cfgs {
+		if err := c.compile(); err != nil {
+			return fmt.Errorf("relabel_configs[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// relabel applies the rules in order to lset, returning nil if the series
+// should be dropped.
+func relabel(lset map[string]string, cfgs []*RelabelConfig) map[string]string {
+	for _, c := range cfgs {
+		values := make([]string, 0, len(c.SourceLabels))
+		for _, name := range c.SourceLabels {
+			values = append(values, lset[name])
+		}
+		val := strings.Join(values, *c.Separator)
+
+		switch c.Action {
+		case relabelDrop:
+			if c.regex.MatchString(val) {
+				return nil
+			}
+		case relabelKeep:
+			if !c.regex.MatchString(val) {
+				return nil
+			}
+		case relabelReplace:
+			indexes := c.regex.FindStringSubmatchIndex(val)
+			if indexes == nil {
+				break
+			}
+			target := string(c.regex.ExpandString(nil, c.TargetLabel, val, indexes))
+			if !model.LabelName(target).IsValid() {
+				break
+			}
+			res := string(c.regex.ExpandString(nil, *c.Replacement, val, indexes))
+			if res == "" {
+				delete(lset, target)
+				break
+			}
+			lset[target] = res
+		case relabelLowercase:
+			lset[c.TargetLabel] = strings.ToLower(val)
+		case relabelHashMod:
+			lset[c.TargetLabel] = fmt.Sprint(sum64(md5.Sum([]byte(val))) % c.Modulus)
+		case relabelLabelMap:
+			mapped := map[string]string{}
+			for name, value := range lset {
+				if c.regex.MatchString(name) {
+					mapped[c.regex.ReplaceAllString(name, *c.Replacement)] = value
+				}
+			}
+			for name, value := range mapped {
+				lset[name] = value
+			}
+		case relabelLabelDrop:
+			for name := range lset {
+				if c.regex.MatchString(name) {
+					delete(lset, name)
+				}
+			}
+		case relabelLabelKeep:
+			for name := range lset {
+				if !c.regex.MatchString(name) {
+					delete(lset, name)
+				}
+			}
+		}
+	}
+	return lset
+}
+
+// sum64 sums the md5 hash to a uint64, as Prometheus does for hashmod.
+func sum64(hash [md5.Size]byte) uint64 {
+	var s uint64
+	for i, b := range hash {
+		shift := uint64((md5.Size - 1 - i) * 8)
+		s |= uint64(b) << shift
+	}
+	return s
+}
+
+// RelabelTransform returns a Transform applying the rules to every series.
+func RelabelTransform(cfgs []*RelabelConfig) Transform {
+	return func(families map[string]*dto.MetricFamily) error {
+		return relabelFamilies(families, cfgs)
+	}
+}
+
+// relabelFamilies applies the rules to every series in families.  Series
+// whose __name__ is rewritten move to the family of that name, and series
+// whose labels collide after relabeling are merged.
+func relabelFamilies(families map[string]*dto.MetricFamily, cfgs []*RelabelConfig) error {
+	if len(cfgs) == 0 {
+		return nil
+	}
+
+	output := make(map[string]*dto.MetricFamily, len(families))
+	for name, family := range families {
+		for _, m := range family.Metric {
+			lset := make(map[string]string, len(m.Label)+1)
+			for _, p := range m.Label {
+				lset[p.GetName()] = p.GetValue()
+			}
+			lset[model.MetricNameLabel] = name
+
+			lset = relabel(lset, cfgs)
+			if lset == nil {
+				continue
+			}
+
+			newName := lset[model.MetricNameLabel]
+			if !model.IsValidMetricName(model.LabelValue(newName)) {
+				return fmt.Errorf("Relabeling produced invalid metric name %q", newName)
+			}
+			target, ok := output[newName]
+			if !ok {
+				target = &dto.MetricFamily{
+					Name: &newName,
+					Help: family.Help,
+					Type: family.Type,
+				}
+				output[newName] = target
+			} else if target.GetType() != family.GetType() {
+				return fmt.Errorf("Relabeling merged metric '%s' into '%s': type %s != %s",
+					name, newName, family.Type.String(), target.Type.String())
+			}
+
+			m.Label = m.Label[:0]
+			for n, v := range lset {
+				// Labels beginning with __ are reserved for relabeling.
+				if strings.HasPrefix(n, model.ReservedLabelPrefix) {
+					continue
+				}
+				n, v := n, v
+				m.Label = append(m.Label, &dto.LabelPair{Name: &n, Value: &v})
+			}
+			sort.Sort(ByName(m.Label))
+			target.Metric = append(target.Metric, m)
+		}
+	}
+
+	for name := range families {
+		delete(families, name)
+	}
+	for name, family := range output {
+		if err := mergeDuplicates(family); err != nil {
+			return err
+		}
+		families[name] = family
+	}
+	return nil
+}
+
+// MergeDuplicates merges series with identical labels within a family, for
+// transforms that can make series identical.  Summaries can't be merged, so
+// identical summary series are an error.
+func MergeDuplicates(f *dto.MetricFamily) error {
+	for _, m := range f.Metric {
+		sort.Sort(ByName(m.Label))
+	}
+	return mergeDuplicates(f)
+}
+
+// mergeDuplicates merges series with identical labels within a family, as
+// they would have been had they been pushed separately.  Summaries can't be
+// merged, so identical summary series are refused rather than dropped.
+// Labels must already be sorted by name.
+func mergeDuplicates(f *dto.MetricFamily) error {
+	sort.Sort(ByLabel(f.Metric))
+	output := f.Metric[:0]
+	for _, m := range f.Metric {
+		last := len(output) - 1
+		if last < 0 || lablesLessThan(output[last].Label, m.Label) {
+			output = append(output, m)
+			continue
+		}
+		merged := mergeMetric(f.GetType(), output[last], m)
+		if merged == nil {
+			return fmt.Errorf("Several series of summary became %s, and summaries can't be merged", seriesString(f.GetName(), m))
+		}
+		output[last] = merged
+	}
+	f.Metric = output
+	return nil
+}
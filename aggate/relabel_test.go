@@ -0,0 +1,103 @@
+package aggate
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadTestRelabelConfigs(t *testing.T, text string) []*RelabelConfig {
+	var cfgs []*RelabelConfig
+	if err := json.Unmarshal([]byte(text), &cfgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompileRelabelConfigs(cfgs); err != nil {
+		t.Fatal(err)
+	}
+	return cfgs
+}
+
+func TestRelabel(t *testing.T) {
+	for _, c := range []struct {
+		cfgs string
+		in   map[string]string
+		want map[string]string
+	}{
+		{
+			cfgs: `[{"source_labels": ["a", "b"], "regex": "(.*);(.*)", "target_label": "c", "replacement": "$2-$1"}]`,
+			in:   map[string]string{"a": "x", "b": "y"},
+			want: map[string]string{"a": "x", "b": "y", "c": "y-x"},
+		},
+		{
+			cfgs: `[{"source_labels": ["a"], "regex": "x", "action": "drop"}]`,
+			in:   map[string]string{"a": "x"},
+		},
+		{
+			cfgs: `[{"source_labels": ["a"], "regex": "x", "action": "keep"}]`,
+			in:   map[string]string{"a": "y"},
+		},
+		{
+			cfgs: `[{"regex": "(user|session)_id", "action": "labeldrop"}]`,
+			in:   map[string]string{"a": "x", "user_id": "1", "session_id": "2"},
+			want: map[string]string{"a": "x"},
+		},
+		{
+			cfgs: `[{"regex": "a|__name__", "action": "labelkeep"}]`,
+			in:   map[string]string{"__name__": "m", "a": "x", "b": "y"},
+			want: map[string]string{"__name__": "m", "a": "x"},
+		},
+		{
+			cfgs: `[{"regex": "meta_(.+)", "action": "labelmap"}]`,
+			in:   map[string]string{"meta_a": "x"},
+			want: map[string]string{"meta_a": "x", "a": "x"},
+		},
+		{
+			cfgs: `[{"source_labels": ["a"], "target_label": "a", "action": "lowercase"}]`,
+			in:   map[string]string{"a": "Chrome"},
+			want: map[string]string{"a": "chrome"},
+		},
+		{
+			cfgs: `[{"source_labels": ["a"], "target_label": "shard", "modulus": 8, "action": "hashmod"}]`,
+			in:   map[string]string{"a": "bar"},
+			want: map[string]string{"a": "bar", "shard": "2"},
+		},
+	} {
+		have := relabel(c.in, loadTestRelabelConfigs(t, c.cfgs))
+		if !reflect.DeepEqual(have, c.want) {
+			t.Fatalf("%s: expected %v, got %v", c.cfgs, c.want, have)
+		}
+	}
+}
+
+func TestRelabelCollapsesSeries(t *testing.T) {
+	a := New(Options{})
+	a.relabelConfigs = loadTestRelabelConfigs(t, `[
+  {"regex": "user_id", "action": "labeldrop"},
+  {"source_labels": ["__name__"], "regex": "ui_errors", "target_label": "__name__", "replacement": "ui_page_render_errors"}
+]`)
+	in := `# HELP ui_errors A counter
+# TYPE ui_errors counter
+ui_errors{path="/org/:orgId",user_id="1"} 1
+ui_errors{path="/prom/:orgId",user_id="1"} 1
+ui_errors{path="/prom/:orgId",user_id="2"} 1
+`
+	if err := a.Push(strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != labelFieldResult {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", labelFieldResult, have)
+	}
+
+	summaries := `# TYPE s summary
+s_sum{user_id="1"} 1
+s_count{user_id="1"} 1
+s_sum{user_id="2"} 2
+s_count{user_id="2"} 1
+`
+	err := a.Push(strings.NewReader(summaries))
+	if want := `Several series of summary became {__name__="s"}, and summaries can't be merged`; err == nil || err.Error() != want {
+		t.Fatalf("Expected %q, got %v", want, err)
+	}
+}
@@ -0,0 +1,114 @@
+package aggate
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	sampleRateHeader = "X-Sample-Rate"
+	sampleRateParam  = "sample_rate"
+	// sampleRateLabel gives the sample rate of a single series.  It is
+	// stripped before the series is stored.
+	sampleRateLabel = "__sample_rate__"
+)
+
+func parseSampleRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(rate > 0 && rate <= 1) {
+		return 0, fmt.Errorf("Invalid sample rate %q: must be in (0, 1]", s)
+	}
+	return rate, nil
+}
+
+// sampleRateTransform returns a Transform scaling counters and histograms
+// pushed by clients that sample events, StatsD-style.  The push's sample
+// rate comes from the X-Sample-Rate header or sample_rate query parameter,
+// and can be overridden per series with the __sample_rate__ label.
+//
+// Untyped families are first typed by name or schema, as they would be
+// later, so an untyped *_total is scaled like any other counter.  Untyped
+// families only typed when merged with a stored family, by the "existing"
+// inference, are not scaled.
+func (a *Aggregator) sampleRateTransform(r *http.Request) Transform {
+	inferTypes := a.inference.transform(a.schema)
+	return func(families map[string]*dto.MetricFamily) error {
+		if err := inferTypes(families); err != nil {
+			return err
+		}
+
+		rate := 1.0
+		if s := r.Header.Get(sampleRateHeader); s != "" {
+			var err error
+			if rate, err = parseSampleRate(s); err != nil {
+				return err
+			}
+		} else if s := r.URL.Query().Get(sampleRateParam); s != "" {
+			var err error
+			if rate, err = parseSampleRate(s); err != nil {
+				return err
+			}
+		}
+
+		for _, family := range families {
+			stripped := false
+			for _, m := range family.Metric {
+				seriesRate := rate
+				for i, p := range m.Label {
+					if p.GetName() != sampleRateLabel {
+						continue
+					}
+					var err error
+					if seriesRate, err = parseSampleRate(p.GetValue()); err != nil {
+						return fmt.Errorf("Metric '%s': %v", family.GetName(), err)
+					}
+					m.Label = append(m.Label[:i], m.Label[i+1:]...)
+					stripped = true
+					break
+				}
+				if seriesRate != 1 {
+					scaleMetric(family.GetType(), m, 1/seriesRate)
+				}
+			}
+
+			// Series differing only in their sample rate are now the same
+			// series.
+			if stripped {
+				for _, m := range family.Metric {
+					sort.Sort(ByName(m.Label))
+				}
+				if err := mergeDuplicates(family); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// scaleMetric multiplies the counts in m by factor.  Gauges and untyped
+// metrics are not counts, so are left alone.
+func scaleMetric(ty dto.MetricType, m *dto.Metric, factor float64) {
+	switch ty {
+	case dto.MetricType_COUNTER:
+		m.Counter.Value = float64ptr(m.Counter.GetValue() * factor)
+
+	case dto.MetricType_HISTOGRAM:
+		// The sum scales along with the count, or the mean would be wrong.
+		h := m.Histogram
+		h.SampleCount = uint64ptr(scaleCount(h.GetSampleCount(), factor))
+		h.SampleSum = float64ptr(h.GetSampleSum() * factor)
+		for _, b := range h.Bucket {
+			b.CumulativeCount = uint64ptr(scaleCount(b.GetCumulativeCount(), factor))
+		}
+	}
+}
+
+func scaleCount(count uint64, factor float64) uint64 {
+	return uint64(math.Round(float64(count) * factor))
+}
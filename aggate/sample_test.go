@@ -0,0 +1,108 @@
+package aggate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSampleRate(t *testing.T) {
+	for _, c := range []struct {
+		url, header, in string
+		inference       string
+		want, err       string
+	}{
+		{
+			url: "http://example.com/metrics/?sample_rate=0.25",
+			in:  multilabel1,
+			want: `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b"} 4
+`,
+		},
+		{
+			url:    "http://example.com/metrics/",
+			header: "0.5",
+			in: `# HELP histogram A histogram
+# TYPE histogram histogram
+histogram_bucket{le="1"} 1
+histogram_bucket{le="+Inf"} 3
+histogram_sum 4.5
+histogram_count 3
+# HELP gauge A gauge
+# TYPE gauge gauge
+gauge 42
+`,
+			want: `# HELP gauge A gauge
+# TYPE gauge gauge
+gauge 42
+# HELP histogram A histogram
+# TYPE histogram histogram
+histogram_bucket{le="1"} 2
+histogram_bucket{le="+Inf"} 6
+histogram_sum 9
+histogram_count 6
+`,
+		},
+		{
+			url: "http://example.com/metrics/?sample_rate=0.5",
+			in: `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",__sample_rate__="0.1"} 1
+counter{a="a"} 1
+`,
+			want: `# HELP counter A counter
+# TYPE counter counter
+counter{a="a"} 12
+`,
+		},
+		{
+			// Untyped counters are scaled once typed by their name.
+			url:       "http://example.com/metrics/",
+			header:    "0.5",
+			in:        "foo_total 1\nbar 1\n",
+			inference: "total-suffix",
+			want: `# TYPE bar untyped
+bar 1
+# TYPE foo_total counter
+foo_total 2
+`,
+		},
+		{
+			url: "http://example.com/metrics/?sample_rate=0",
+			in:  multilabel1,
+			err: `Invalid sample rate "0": must be in (0, 1]`,
+		},
+		{
+			url: "http://example.com/metrics/",
+			in: `# HELP counter A counter
+# TYPE counter counter
+counter{__sample_rate__="2"} 1
+`,
+			err: `Metric 'counter': Invalid sample rate "2": must be in (0, 1]`,
+		},
+	} {
+		r := httptest.NewRequest("POST", c.url, nil)
+		if c.header != "" {
+			r.Header.Set(sampleRateHeader, c.header)
+		}
+		inference, err := ParseTypeInference(c.inference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := New(Options{Inference: inference})
+		err = a.Push(strings.NewReader(c.in), a.sampleRateTransform(r))
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Fatalf("Expected %s, got %v", c.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != c.want {
+			t.Fatalf("Expected:\n%s\ngot:\n%s", c.want, have)
+		}
+	}
+}
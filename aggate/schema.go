@@ -0,0 +1,172 @@
+package aggate
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// Reject pushes containing families not declared in the schema.
+	unknownReject = "reject"
+	// Silently drop families not declared in the schema.
+	unknownDrop = "drop"
+)
+
+// Schema declares the families clients may push.  Since browsers push
+// directly to the gateway, anyone can send anything; a schema keeps
+// arbitrary families out.
+type Schema struct {
+	// Unknown says what to do with undeclared families: "reject" (the
+	// default) or "drop".
+	Unknown  string         `json:"unknown"`
+	Families []FamilySchema `json:"families"`
+
+	byName map[string]*FamilySchema // Families by name, set by Compile
+}
+
+// FamilySchema declares a single family.
+type FamilySchema struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Help, if set, replaces whatever HELP text clients push.
+	Help string `json:"help"`
+	// Labels lists the allowed label names; any other label is rejected.
+	Labels map[string]LabelSchema `json:"labels"`
+	// Buckets, if set, are the only upper bounds allowed for a histogram,
+	// besides +Inf.
+	Buckets []float64 `json:"buckets"`
+
+	metricType dto.MetricType
+}
+
+// LabelSchema optionally restricts the values of a label, either to a regex
+// or to an enumeration.
+type LabelSchema struct {
+	Regex  string   `json:"regex"`
+	Values []string `json:"values"`
+
+	regex  *regexp.Regexp
+	values map[string]struct{}
+}
+
+// Compile checks the schema and prepares it for use.
+func (s *Schema) Compile() error {
+	switch s.Unknown {
+	case "":
+		s.Unknown = unknownReject
+	case unknownReject, unknownDrop:
+	default:
+		return fmt.Errorf("Unknown schema policy for unknown families %q", s.Unknown)
+	}
+
+	s.byName = make(map[string]*FamilySchema, len(s.Families))
+	for i := range s.Families {
+		f := &s.Families[i]
+		if _, ok := s.byName[f.Name]; ok {
+			return fmt.Errorf("Metric '%s' declared twice", f.Name)
+		}
+		s.byName[f.Name] = f
+
+		t, ok := dto.MetricType_value[strings.ToUpper(f.Type)]
+		if !ok {
+			return fmt.Errorf("Metric '%s' has unknown type %q", f.Name, f.Type)
+		}
+		f.metricType = dto.MetricType(t)
+
+		for name, l := range f.Labels {
+			if l.Regex != "" {
+				re, err := regexp.Compile("^(?:" + l.Regex + ")$")
+				if err != nil {
+					return fmt.Errorf("Metric '%s' label '%s': %v", f.Name, name, err)
+				}
+				l.regex = re
+			}
+			if len(l.Values) > 0 {
+				l.values = make(map[string]struct{}, len(l.Values))
+				for _, v := range l.Values {
+					l.values[v] = struct{}{}
+				}
+			}
+			f.Labels[name] = l
+		}
+	}
+	return nil
+}
+
+// lookup returns the declaration of a family, or nil if there is none.
+func (s *Schema) lookup(name string) *FamilySchema {
+	if s == nil {
+		return nil
+	}
+	return s.byName[name]
+}
+
+// drops reports whether a pushed family should be silently dropped for not
+// being declared.
+func (s *Schema) drops(name string) bool {
+	return s != nil && s.Unknown == unknownDrop && s.byName[name] == nil
+}
+
+// check verifies a pushed family against the schema, and replaces its HELP
+// with the declared one.
+func (s *Schema) check(f *dto.MetricFamily) error {
+	if s == nil {
+		return nil
+	}
+	fs := s.lookup(f.GetName())
+	if fs == nil {
+		return fmt.Errorf("Metric '%s' is not declared in the schema", f.GetName())
+	}
+	if f.GetType() != fs.metricType {
+		return fmt.Errorf("Metric '%s' must be of type %s, not %s",
+			f.GetName(), fs.metricType.String(), f.GetType().String())
+	}
+	if fs.Help != "" {
+		f.Help = &fs.Help
+	}
+
+	for _, m := range f.Metric {
+		for _, p := range m.Label {
+			l, ok := fs.Labels[p.GetName()]
+			if !ok {
+				return fmt.Errorf("Metric '%s' does not allow label '%s'", f.GetName(), p.GetName())
+			}
+			if l.regex != nil && !l.regex.MatchString(p.GetValue()) {
+				return fmt.Errorf("Metric '%s' label '%s' value %q does not match %q",
+					f.GetName(), p.GetName(), p.GetValue(), l.Regex)
+			}
+			if l.values != nil {
+				if _, ok := l.values[p.GetValue()]; !ok {
+					return fmt.Errorf("Metric '%s' label '%s' value %q is not one of %q",
+						f.GetName(), p.GetName(), p.GetValue(), l.Values)
+				}
+			}
+		}
+		if len(fs.Buckets) > 0 && m.Histogram != nil {
+			if err := fs.checkBuckets(m.Histogram.Bucket); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *FamilySchema) checkBuckets(buckets []*dto.Bucket) error {
+	allowed := make(map[float64]struct{}, len(fs.Buckets))
+	for _, b := range fs.Buckets {
+		allowed[b] = struct{}{}
+	}
+	for _, b := range buckets {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			continue
+		}
+		if _, ok := allowed[b.GetUpperBound()]; !ok {
+			return fmt.Errorf("Metric '%s' does not allow bucket le=\"%g\"", fs.Name, b.GetUpperBound())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package aggate
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+  "families": [
+    {
+      "name": "ui_page_render_errors",
+      "type": "counter",
+      "help": "Page render errors by route",
+      "labels": {"path": {"regex": "(/[a-z]+(/:[a-zA-Z]+)?)+"}}
+    },
+    {
+      "name": "ui_external_lib_loaded",
+      "type": "gauge",
+      "labels": {"name": {}, "loaded": {"values": ["true", "false"]}}
+    },
+    {
+      "name": "histogram",
+      "type": "histogram",
+      "buckets": [1, 2, 3, 4, 5, 6, 7, 8, 9, 10]
+    }
+  ]
+}`
+
+func loadTestSchema(t *testing.T, unknown string) *Schema {
+	s := &Schema{}
+	if err := json.Unmarshal([]byte(testSchema), s); err != nil {
+		t.Fatal(err)
+	}
+	s.Unknown = unknown
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSchema(t *testing.T) {
+	for _, c := range []struct {
+		unknown string
+		in      string
+		err     string
+		want    string
+	}{
+		{
+			in: labelFields1,
+			want: `# HELP ui_page_render_errors Page render errors by route
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/org/:orgId"} 1
+ui_page_render_errors{path="/prom/:orgId"} 1
+`,
+		},
+		{
+			in:  `ui_page_render_errors{path="/org/1234"} 1`,
+			err: `Metric 'ui_page_render_errors' must be of type COUNTER, not UNTYPED`,
+		},
+		{
+			in: `# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/org/1234"} 1`,
+			err: `Metric 'ui_page_render_errors' label 'path' value "/org/1234" does not match "(/[a-z]+(/:[a-zA-Z]+)?)+"`,
+		},
+		{
+			in: `# TYPE ui_external_lib_loaded gauge
+ui_external_lib_loaded{name="ga",loaded="maybe"} 1`,
+			err: `Metric 'ui_external_lib_loaded' label 'loaded' value "maybe" is not one of ["true" "false"]`,
+		},
+		{
+			in: `# TYPE ui_external_lib_loaded gauge
+ui_external_lib_loaded{name="ga",user="bob"} 1`,
+			err: `Metric 'ui_external_lib_loaded' does not allow label 'user'`,
+		},
+		{
+			in: `# TYPE histogram histogram
+histogram_bucket{le="0.5"} 1
+histogram_bucket{le="+Inf"} 1
+histogram_sum 0.1
+histogram_count 1`,
+			err: `Metric 'histogram' does not allow bucket le="0.5"`,
+		},
+		{
+			in:  in1,
+			err: `Metric 'counter' is not declared in the schema`,
+		},
+		{
+			unknown: unknownDrop,
+			in:      multilabel1,
+		},
+	} {
+		a := New(Options{})
+		a.schema = loadTestSchema(t, c.unknown)
+
+		err := a.Push(strings.NewReader(c.in + "\n"))
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Fatalf("Expected %s, got %v", c.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != c.want {
+			t.Fatalf("Expected:\n%s\ngot:\n%s", c.want, have)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package aggate
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// storedFamily is an aggregator's state for a single metric family.  Each has
+// its own lock, so pushes to different families merge in parallel, and
+// scrapes only wait for the family they are reading.
+//
+// Series are indexed by the fingerprint of their labels, so a push only
+// costs as much as the series it contains, however many are stored.
+type storedFamily struct {
+	lock        sync.Mutex
+	name        string
+	metricType  dto.MetricType
+	help        *string
+	series      map[uint64][]*storedSeries // Fingerprint -> series; nil until a series is stored
+	numSeries   int                        // Number of series in series
+	bytes       int64                      // Approximate memory used by series, labelValues, helps and encoded
+	labelValues map[string]map[string]int  // Label name -> value -> series with it; nil unless limited
+	helps       map[string]int             // HELP -> pushes seen, for up to maxHelpVariants texts
+	otherHelps  int                        // Pushes of HELP texts not in helps
+	removed     bool                       // No longer in the aggregator's families
+
+	// generation counts changes to the family, so an exposition encoded
+	// while it was unlocked can tell whether it is still current.  encoded
+	// caches the current exposition in each format.
+	generation uint64
+	encoded    map[expfmt.Format][]byte
+}
+
+// newStoredFamily returns an empty family, which only tracks its label
+// values if trackValues is set, as they are only needed to enforce
+// MaxLabelValuesPerLabel.
+func newStoredFamily(name string, trackValues bool) *storedFamily {
+	sf := &storedFamily{
+		name:  name,
+		helps: map[string]int{},
+	}
+	if trackValues {
+		sf.labelValues = map[string]map[string]int{}
+	}
+	return sf
+}
+
+// FNV-1a, as used by the Prometheus model for fingerprints.
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// labelsFingerprint hashes labels, which must be sorted by name.
+func labelsFingerprint(labels []*dto.LabelPair) uint64 {
+	h := uint64(offset64)
+	for _, p := range labels {
+		for _, s := range []string{p.GetName(), p.GetValue()} {
+			for i := 0; i < len(s); i++ {
+				h ^= uint64(s[i])
+				h *= prime64
+			}
+			// Separate strings, so {a="bc"} and {ab="c"} differ.
+			h ^= 0xff
+			h *= prime64
+		}
+	}
+	return h
+}
+
+func labelsEqual(a, b []*dto.LabelPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].GetName() != b[i].GetName() || a[i].GetValue() != b[i].GetValue() {
+			return false
+		}
+	}
+	return true
+}
+
+// storedSeries is a series of a storedFamily.
+type storedSeries struct {
+	// metric is replaced rather than modified, so a snapshot may share it.
+	metric  *dto.Metric
+	updated uint64 // updateClock when last merged into
+	bytes   int64  // Approximate memory used by metric
+}
+
+// updateClock orders merges, so the least recently updated series can be
+// found.
+var updateClock uint64
+
+// get returns the stored series with labels, which hash to fp, or nil.
+func (sf *storedFamily) get(fp uint64, labels []*dto.LabelPair) *storedSeries {
+	for _, s := range sf.series[fp] {
+		if labelsEqual(s.metric.Label, labels) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (sf *storedFamily) add(fp uint64, m *dto.Metric, now uint64) {
+	if sf.series == nil {
+		sf.series = map[uint64][]*storedSeries{}
+	}
+	m.Label = labelPool.internLabels(m.Label)
+	s := &storedSeries{metric: m, updated: now, bytes: seriesBytes(m)}
+	sf.series[fp] = append(sf.series[fp], s)
+	sf.numSeries++
+	sf.bytes += s.bytes
+	if sf.labelValues != nil {
+		for _, p := range m.Label {
+			if sf.labelValues[p.GetName()] == nil {
+				sf.labelValues[p.GetName()] = map[string]int{}
+			}
+			if sf.labelValues[p.GetName()][p.GetValue()]++; sf.labelValues[p.GetName()][p.GetValue()] == 1 {
+				sf.bytes += labelValueOverhead
+			}
+		}
+	}
+}
+
+func (sf *storedFamily) update(s *storedSeries, m *dto.Metric, now uint64) {
+	bytes := seriesBytes(m)
+	sf.bytes += bytes - s.bytes
+	s.metric, s.updated, s.bytes = m, now, bytes
+}
+
+func (sf *storedFamily) remove(fp uint64, s *storedSeries) {
+	ss := sf.series[fp]
+	for i := range ss {
+		if ss[i] != s {
+			continue
+		}
+		if len(ss) == 1 {
+			delete(sf.series, fp)
+		} else {
+			sf.series[fp] = append(ss[:i:i], ss[i+1:]...)
+		}
+		sf.numSeries--
+		sf.bytes -= s.bytes
+		if sf.labelValues != nil {
+			for _, p := range s.metric.Label {
+				values := sf.labelValues[p.GetName()]
+				if values[p.GetValue()]--; values[p.GetValue()] <= 0 {
+					delete(values, p.GetValue())
+					sf.bytes -= labelValueOverhead
+				}
+				if len(values) == 0 {
+					delete(sf.labelValues, p.GetName())
+				}
+			}
+		}
+		labelPool.releaseLabels(s.metric.Label)
+		// An emptied family is treated as new, as if it had never
+		// been stored.
+		if sf.numSeries == 0 {
+			sf.series = nil
+		}
+		return
+	}
+}
+
+// clear removes every series.
+func (sf *storedFamily) clear() {
+	for fp, ss := range sf.series {
+		for _, s := range ss {
+			sf.remove(fp, s)
+		}
+	}
+}
+
+// merge adds the pushed family f into sf, which must be of the same type,
+// and returns the number of stored series it removed.
+func (sf *storedFamily) merge(f *dto.MetricFamily) int {
+	sf.changed()
+	if sf.series == nil {
+		sf.series = make(map[uint64][]*storedSeries, len(f.Metric))
+		sf.metricType = f.GetType()
+	}
+	removed := 0
+	now := atomic.AddUint64(&updateClock, 1)
+	for _, m := range f.Metric {
+		fp := labelsFingerprint(m.Label)
+		existing := sf.get(fp, m.Label)
+		if existing == nil {
+			sf.add(fp, m, now)
+		} else if merged := mergeMetric(sf.metricType, existing.metric, m); merged != nil {
+			sf.update(existing, merged, now)
+		} else {
+			// Summaries can't be merged, so are removed.
+			sf.remove(fp, existing)
+			removed++
+		}
+	}
+	return removed
+}
+
+// changed records a change to the family, dropping its now stale cached
+// expositions.
+func (sf *storedFamily) changed() {
+	sf.generation++
+	for _, buf := range sf.encoded {
+		sf.bytes -= int64(len(buf))
+	}
+	sf.encoded = nil
+}
+
+// snapshot returns the family with its series unsorted, or nil if it has
+// none.  sf must be locked, but the result may be used after unlocking it.
+func (sf *storedFamily) snapshot() *dto.MetricFamily {
+	if sf.numSeries == 0 {
+		return nil
+	}
+	ty := sf.metricType
+	f := &dto.MetricFamily{
+		Name:   &sf.name,
+		Help:   sf.help,
+		Type:   &ty,
+		Metric: make([]*dto.Metric, 0, sf.numSeries),
+	}
+	for _, ss := range sf.series {
+		for _, s := range ss {
+			f.Metric = append(f.Metric, s.metric)
+		}
+	}
+	return f
+}
+
+// lockFamilies returns the stored state of the named families, creating any
+// that are missing, with each locked.  names must be sorted, so concurrent
+// pushes lock families in the same order.
+func (a *Aggregator) lockFamilies(names []string) []*storedFamily {
+	for {
+		stored := make([]*storedFamily, len(names))
+		var missing bool
+		a.familiesLock.RLock()
+		for i, name := range names {
+			stored[i] = a.families[name]
+			missing = missing || stored[i] == nil
+		}
+		a.familiesLock.RUnlock()
+
+		if missing {
+			a.familiesLock.Lock()
+			for i, name := range names {
+				if stored[i] != nil {
+					continue
+				}
+				if stored[i] = a.families[name]; stored[i] == nil {
+					stored[i] = newStoredFamily(name, a.limits.MaxLabelValuesPerLabel > 0)
+					a.families[name] = stored[i]
+				}
+			}
+			a.familiesLock.Unlock()
+		}
+
+		removed := false
+		for _, sf := range stored {
+			sf.lock.Lock()
+			removed = removed || sf.removed
+		}
+		if !removed {
+			return stored
+		}
+		// Raced with unlockFamilies removing an empty family; try again.
+		a.unlockFamilies(names, stored)
+	}
+}
+
+// unlockFamilies unlocks families locked by lockFamilies, first removing any
+// left without series so rejected pushes don't leave entries behind.
+func (a *Aggregator) unlockFamilies(names []string, stored []*storedFamily) {
+	var empty bool
+	for _, sf := range stored {
+		empty = empty || (sf.series == nil && !sf.removed)
+	}
+	if empty {
+		a.familiesLock.Lock()
+		for i, sf := range stored {
+			if sf.series == nil && !sf.removed {
+				a.removeFamily(names[i], sf)
+			}
+		}
+		a.familiesLock.Unlock()
+	}
+	for _, sf := range stored {
+		sf.lock.Unlock()
+	}
+}
+
+// removeFamily forgets a family left without series, along with the memory
+// its HELP variants and cached expositions still account for.  familiesLock
+// must be held, and sf locked.
+func (a *Aggregator) removeFamily(name string, sf *storedFamily) {
+	sf.removed = true
+	delete(a.families, name)
+	a.memory.add(-sf.bytes)
+	sf.bytes = 0
+	sf.encoded = nil
+}
+
+// storedFamilies returns the names of all families, sorted, and their
+// stored state, which may not have any series yet.
+func (a *Aggregator) storedFamilies() ([]string, []*storedFamily) {
+	a.familiesLock.RLock()
+	defer a.familiesLock.RUnlock()
+	names := make([]string, 0, len(a.families))
+	for name := range a.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stored := make([]*storedFamily, len(names))
+	for i, name := range names {
+		stored[i] = a.families[name]
+	}
+	return names, stored
+}
+
+// current returns a snapshot of the family, with its series sorted, or nil
+// if it has none.
+func (sf *storedFamily) current() *dto.MetricFamily {
+	sf.lock.Lock()
+	f := sf.snapshot()
+	sf.lock.Unlock()
+	if f != nil {
+		sort.Sort(ByLabel(f.Metric))
+	}
+	return f
+}
+
+// encode returns the family's exposition in format, which is cached until
+// the family next changes.  The cache's memory is counted by memory.
+// Encoding happens without the lock, so pushes aren't held up by scrapes.
+func (sf *storedFamily) encode(format expfmt.Format, memory *MemoryTracker) ([]byte, error) {
+	sf.lock.Lock()
+	if buf, ok := sf.encoded[format]; ok {
+		sf.lock.Unlock()
+		return buf, nil
+	}
+	f, generation := sf.snapshot(), sf.generation
+	sf.lock.Unlock()
+	if f == nil {
+		return nil, nil
+	}
+
+	sort.Sort(ByLabel(f.Metric))
+	var buf bytes.Buffer
+	if err := expfmt.NewEncoder(&buf, format).Encode(f); err != nil {
+		return nil, err
+	}
+
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	// Another scrape may have cached the same exposition meanwhile.
+	if _, ok := sf.encoded[format]; sf.generation == generation && !sf.removed && !ok {
+		if sf.encoded == nil {
+			sf.encoded = map[expfmt.Format][]byte{}
+		}
+		sf.encoded[format] = buf.Bytes()
+		sf.bytes += int64(buf.Len())
+		memory.add(int64(buf.Len()))
+	}
+	return buf.Bytes(), nil
+}
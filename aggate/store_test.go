@@ -0,0 +1,137 @@
+package aggate
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentPushes(t *testing.T) {
+	a := New(Options{})
+	const pushers, pushes = 8, 50
+
+	var wg sync.WaitGroup
+	for p := 0; p < pushers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < pushes; i++ {
+				// Every pusher shares one family, and has one of its own.
+				body := fmt.Sprintf("# TYPE shared counter\nshared 1\n# TYPE own_%d counter\nown_%d 1\n", p, p)
+				if err := a.Push(strings.NewReader(body)); err != nil {
+					t.Error(err)
+					return
+				}
+				scrape(http.HandlerFunc(a.handler), "/metrics", "", "")
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	have := scrape(http.HandlerFunc(a.handler), "/metrics", "", "")
+	want := fmt.Sprintf("# TYPE shared counter\nshared %d\n", pushers*pushes)
+	if !strings.HasSuffix(have, want) {
+		t.Fatalf("Expected suffix:\n%s\ngot:\n%s", want, have)
+	}
+	if a.numFamilies != pushers+1 || a.series != pushers+1 {
+		t.Fatalf("Expected %d families and series, have %d and %d", pushers+1, a.numFamilies, a.series)
+	}
+}
+
+func TestRejectedPushLeavesNoFamilies(t *testing.T) {
+	a := New(Options{})
+	a.limits = Limits{MaxSeries: 1}
+	if err := a.Push(strings.NewReader(multilabel1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Push(strings.NewReader(gaugeInput)); err == nil {
+		t.Fatal("Expected push to be rejected")
+	}
+	if len(a.families) != 1 {
+		t.Fatalf("Expected only the first push's family to be stored, have %d", len(a.families))
+	}
+}
+
+// largeFamily returns a push of a counter family with n series.
+func largeFamily(n int) string {
+	var b strings.Builder
+	b.WriteString("# TYPE requests_total counter\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "requests_total{path=\"/page/%d\"} 1\n", i)
+	}
+	return b.String()
+}
+
+func BenchmarkPushIntoLargeFamily(b *testing.B) {
+	a := New(Options{})
+	if err := a.Push(strings.NewReader(largeFamily(50000))); err != nil {
+		b.Fatal(err)
+	}
+	const push = "# TYPE requests_total counter\nrequests_total{path=\"/page/123\"} 1\n"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := a.Push(strings.NewReader(push)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScrapeLargeFamily(b *testing.B) {
+	a := New(Options{})
+	if err := a.Push(strings.NewReader(largeFamily(50000))); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.Snapshot()
+	}
+}
+
+func TestEncodedCache(t *testing.T) {
+	a := New(Options{})
+	if err := a.Push(strings.NewReader(multilabel1)); err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(a.handler)
+	first := scrape(h, "/metrics", "", "")
+	if second := scrape(h, "/metrics", "", ""); second != first {
+		t.Fatalf("Expected cached scrape to match:\n%s\ngot:\n%s", first, second)
+	}
+	sf := a.families["counter"]
+	if len(sf.encoded) != 1 {
+		t.Fatalf("Expected one cached encoding, have %d", len(sf.encoded))
+	}
+
+	// A protobuf scrape is cached alongside the text one.
+	r := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+	r.Header.Set("Accept", `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited`)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if len(sf.encoded) != 2 {
+		t.Fatalf("Expected two cached encodings, have %d", len(sf.encoded))
+	}
+
+	if err := a.Push(strings.NewReader(multilabel2)); err != nil {
+		t.Fatal(err)
+	}
+	if have := scrape(h, "/metrics", "", ""); have == first {
+		t.Fatal("Expected a push to invalidate the cached scrape")
+	}
+}
+
+func BenchmarkHandlerLargeFamily(b *testing.B) {
+	a := New(Options{})
+	if err := a.Push(strings.NewReader(largeFamily(50000))); err != nil {
+		b.Fatal(err)
+	}
+	h := http.HandlerFunc(a.handler)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scrape(h, "/metrics", "", "")
+	}
+}
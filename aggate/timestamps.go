@@ -0,0 +1,60 @@
+package aggate
+
+import (
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Policies for samples pushed with a timestamp.
+const (
+	// TimestampsStrip drops client timestamps, so series are exposed as
+	// current samples.
+	TimestampsStrip = "strip"
+	// TimestampsReject rejects pushes containing any timestamp.
+	TimestampsReject = "reject"
+	// TimestampsNewest keeps the newest timestamp of the samples merged
+	// into each series.
+	TimestampsNewest = "newest"
+)
+
+// ValidateTimestampPolicy checks that policy is one of the timestamp
+// policies.
+func ValidateTimestampPolicy(policy string) error {
+	switch policy {
+	case TimestampsStrip, TimestampsReject, TimestampsNewest:
+		return nil
+	}
+	return fmt.Errorf("Unknown timestamp policy %q", policy)
+}
+
+// timestampTransform returns a Transform applying policy to the timestamps
+// of pushed samples.
+func timestampTransform(policy string) Transform {
+	return func(families map[string]*dto.MetricFamily) error {
+		if policy == TimestampsNewest {
+			return nil
+		}
+		for name, family := range families {
+			for _, m := range family.Metric {
+				if m.TimestampMs == nil {
+					continue
+				}
+				if policy == TimestampsReject {
+					return fmt.Errorf("Invalid series %s: samples must not have timestamps", seriesString(name, m))
+				}
+				m.TimestampMs = nil
+			}
+		}
+		return nil
+	}
+}
+
+// newestTimestamp returns the later of a's and b's timestamps, or nil if
+// neither has one.
+func newestTimestamp(a, b *dto.Metric) *int64 {
+	if a.TimestampMs == nil || (b.TimestampMs != nil && b.GetTimestampMs() > a.GetTimestampMs()) {
+		return b.TimestampMs
+	}
+	return a.TimestampMs
+}
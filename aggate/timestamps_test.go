@@ -0,0 +1,67 @@
+package aggate
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTimestamps(t *testing.T) {
+	const (
+		push1 = `# TYPE counter counter
+counter{a="a"} 1 2000
+counter{a="b"} 1 3000
+`
+		push2 = `# TYPE counter counter
+counter{a="a"} 2 1000
+counter{a="c"} 3
+`
+	)
+	for _, c := range []struct {
+		policy, want, err string
+	}{
+		{
+			policy: TimestampsStrip,
+			want: `# TYPE counter counter
+counter{a="a"} 3
+counter{a="b"} 1
+counter{a="c"} 3
+`,
+		},
+		{
+			policy: TimestampsNewest,
+			want: `# TYPE counter counter
+counter{a="a"} 3 2000
+counter{a="b"} 1 3000
+counter{a="c"} 3
+`,
+		},
+		{
+			policy: TimestampsReject,
+			err:    `Invalid series {__name__="counter", a="a"}: samples must not have timestamps`,
+		},
+	} {
+		a := New(Options{})
+		a.timestamps = c.policy
+		err := a.Push(strings.NewReader(push1))
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: expected error %q, got %v", c.policy, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Push(strings.NewReader(push2)); err != nil {
+			t.Fatal(err)
+		}
+		if have := scrape(http.HandlerFunc(a.handler), "/metrics", "", ""); have != c.want {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", c.policy, c.want, have)
+		}
+	}
+
+	if err := ValidateTimestampPolicy("oldest"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
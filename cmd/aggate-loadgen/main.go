@@ -0,0 +1,218 @@
+// Command aggate-loadgen pushes synthetic browser-like traffic to a running
+// prom-aggregation-gateway and reports throughput and latency percentiles.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// browserPages are the route templates synthetic clients report.
+var browserPages = []string{"/", "/org/:orgId", "/prom/:orgId", "/prom/:orgId/explore", "/settings", "/login"}
+
+// browserLibs are the third party libraries synthetic clients load.
+var browserLibs = []string{"ga", "Intercom", "mixpanel", "segment", "sentry"}
+
+// loadBuckets are the bounds of the page load histogram.
+var loadBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// browserPush returns one client's push: render errors and load times per
+// page, and which libraries loaded.  pages limits the pages visited.
+func browserPush(rnd *rand.Rand, pages int) string {
+	var b strings.Builder
+	b.WriteString("# HELP ui_page_render_errors Page render errors\n# TYPE ui_page_render_errors counter\n")
+	for _, page := range browserPages[:pages] {
+		fmt.Fprintf(&b, "ui_page_render_errors{path=%q} %d\n", page, rnd.Intn(2))
+	}
+	b.WriteString("# HELP ui_external_lib_loaded Whether external libraries loaded\n# TYPE ui_external_lib_loaded gauge\n")
+	for _, lib := range browserLibs {
+		loaded := "true"
+		if rnd.Intn(20) == 0 {
+			loaded = "false"
+		}
+		fmt.Fprintf(&b, "ui_external_lib_loaded{name=%q,loaded=%q} 1\n", lib, loaded)
+	}
+	b.WriteString("# HELP ui_page_load_seconds Page load times\n# TYPE ui_page_load_seconds histogram\n")
+	for _, page := range browserPages[:pages] {
+		load := rnd.ExpFloat64()
+		for _, le := range loadBuckets {
+			n := 0
+			if load <= le {
+				n = 1
+			}
+			fmt.Fprintf(&b, "ui_page_load_seconds_bucket{path=%q,le=\"%g\"} %d\n", page, le, n)
+		}
+		fmt.Fprintf(&b, "ui_page_load_seconds_bucket{path=%q,le=\"+Inf\"} 1\n", page)
+		fmt.Fprintf(&b, "ui_page_load_seconds_sum{path=%q} %g\n", page, load)
+		fmt.Fprintf(&b, "ui_page_load_seconds_count{path=%q} 1\n", page)
+	}
+	return b.String()
+}
+
+// result is the outcome of one push.
+type result struct {
+	latency time.Duration
+	err     error
+}
+
+// loadgen pushes to url from clients concurrent clients until stop is
+// closed, each waiting interval between pushes.
+type loadgen struct {
+	url      string
+	header   http.Header
+	clients  int
+	pages    int
+	interval time.Duration
+	client   *http.Client
+}
+
+func (l *loadgen) run(stop <-chan struct{}) []result {
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < l.clients; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				results <- l.push(browserPush(rnd, l.pages))
+				if l.interval > 0 {
+					select {
+					case <-stop:
+						return
+					case <-time.After(l.interval):
+					}
+				}
+			}
+		}(int64(i))
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var all []result
+	for r := range results {
+		all = append(all, r)
+	}
+	return all
+}
+
+func (l *loadgen) push(body string) result {
+	req, err := http.NewRequest("POST", l.url, strings.NewReader(body))
+	if err != nil {
+		return result{err: err}
+	}
+	for name, values := range l.header {
+		req.Header[name] = values
+	}
+	start := time.Now()
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return result{err: err}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+	if resp.StatusCode/100 != 2 {
+		return result{latency: latency, err: fmt.Errorf("%s", resp.Status)}
+	}
+	return result{latency: latency}
+}
+
+// percentile returns the pth percentile of sorted latencies, by the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// report writes the throughput and latencies of results over elapsed.
+func report(w io.Writer, results []result, elapsed time.Duration) {
+	var latencies []time.Duration
+	errors := map[string]int{}
+	for _, r := range results {
+		if r.err != nil {
+			errors[r.err.Error()]++
+			continue
+		}
+		latencies = append(latencies, r.latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Fprintf(w, "pushes:     %d in %s\n", len(results), elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput: %.1f pushes/s\n", float64(len(latencies))/elapsed.Seconds())
+	fmt.Fprintf(w, "errors:     %d\n", len(results)-len(latencies))
+	messages := make([]string, 0, len(errors))
+	for msg := range errors {
+		messages = append(messages, msg)
+	}
+	sort.Strings(messages)
+	for _, msg := range messages {
+		fmt.Fprintf(w, "  %d x %s\n", errors[msg], msg)
+	}
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		fmt.Fprintf(w, "p%-9g %s\n", p, percentile(latencies, p))
+	}
+	if len(latencies) > 0 {
+		fmt.Fprintf(w, "max        %s\n", latencies[len(latencies)-1])
+	}
+}
+
+func main() {
+	var (
+		url          = flag.String("url", "http://localhost/metrics/", "Push URL of the gateway.")
+		clients      = flag.Int("clients", 10, "Number of concurrent clients.")
+		duration     = flag.Duration("duration", 10*time.Second, "How long to push for.")
+		interval     = flag.Duration("interval", 0, "How long each client waits between pushes.")
+		pages        = flag.Int("pages", len(browserPages), "Number of pages each client reports.")
+		tenantHeader = flag.String("tenant-header", "", "Header to send the tenant ID in.")
+		tenant       = flag.String("tenant", "", "Tenant ID to push as.")
+	)
+	flag.Parse()
+	if *pages < 1 || *pages > len(browserPages) {
+		log.Fatalf("-pages must be between 1 and %d", len(browserPages))
+	}
+
+	l := &loadgen{
+		url:      *url,
+		header:   http.Header{},
+		clients:  *clients,
+		pages:    *pages,
+		interval: *interval,
+		client:   &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *clients}},
+	}
+	if *tenantHeader != "" {
+		l.header.Set(*tenantHeader, *tenant)
+	}
+
+	stop := make(chan struct{})
+	time.AfterFunc(*duration, func() { close(stop) })
+	start := time.Now()
+	results := l.run(stop)
+	report(os.Stdout, results, time.Since(start))
+}
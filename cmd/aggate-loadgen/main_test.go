@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestBrowserPush(t *testing.T) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(browserPush(rand.New(rand.NewSource(1)), 2)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for name, want := range map[string]int{
+		"ui_page_render_errors":  2,
+		"ui_external_lib_loaded": len(browserLibs),
+		"ui_page_load_seconds":   2,
+	} {
+		if have := len(families[name].GetMetric()); have != want {
+			t.Errorf("Expected %d series of %s, got %d", want, name, have)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for _, c := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 1 * time.Millisecond},
+		{50, 50 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{99.9, 100 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	} {
+		if have := percentile(sorted, c.p); have != c.want {
+			t.Errorf("Expected p%g to be %s, got %s", c.p, c.want, have)
+		}
+	}
+	if have := percentile(nil, 50); have != 0 {
+		t.Errorf("Expected p50 of nothing to be 0, got %s", have)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var pushes int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Scope-OrgID") != "team" {
+			http.Error(w, "missing tenant", http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt64(&pushes, 1)%2 == 0 {
+			http.Error(w, "too many", http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	l := &loadgen{
+		url:     server.URL,
+		header:  http.Header{"X-Scope-Orgid": {"team"}},
+		clients: 4,
+		pages:   len(browserPages),
+		client:  server.Client(),
+	}
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	results := l.run(stop)
+	if int64(len(results)) != atomic.LoadInt64(&pushes) {
+		t.Fatalf("Expected %d results, got %d", pushes, len(results))
+	}
+
+	var out bytes.Buffer
+	report(&out, results, time.Second)
+	if !strings.Contains(out.String(), "429 Too Many Requests") || !strings.Contains(out.String(), "p99") {
+		t.Fatalf("Unexpected report:\n%s", out.String())
+	}
+}
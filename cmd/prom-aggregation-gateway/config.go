@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+// config is the optional JSON configuration file given by -config.
+type config struct {
+	// Tenants holds per-tenant overrides of the default limits, and
+	// per-tenant relabeling rules.
+	Tenants map[string]tenantConfig `json:"tenants"`
+	// PushPaths holds relabeling rules for pushes to particular paths.  Paths
+	// other than -push-path are also registered to accept pushes.
+	PushPaths map[string]pushPathConfig `json:"push_paths"`
+	// Schema, if set, declares the only families clients may push.
+	Schema *aggate.Schema `json:"schema"`
+	// Normalize holds rewrite rules for label values, by label name.
+	Normalize aggate.NormalizeConfig `json:"normalize"`
+	// TrustedProxies lists the CIDRs whose X-Forwarded-For headers are
+	// believed when Inject and GeoIP determine the client IP.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Inject adds labels derived from each push request.
+	Inject *injectConfig `json:"inject"`
+	// UserAgent attaches labels parsed from each push's User-Agent.
+	UserAgent *userAgentConfig `json:"user_agent"`
+	// GeoIP attaches labels locating each push's client IP.
+	GeoIP *geoIPConfig `json:"geoip"`
+	// Help gives the HELP of families by name, used with -help-policy=config.
+	Help map[string]string `json:"help"`
+
+	trustedProxies []*net.IPNet
+}
+
+type tenantConfig struct {
+	aggate.Limits
+	RelabelConfigs []*aggate.RelabelConfig `json:"relabel_configs"`
+}
+
+type pushPathConfig struct {
+	RelabelConfigs []*aggate.RelabelConfig `json:"relabel_configs"`
+}
+
+func loadConfig(filename string) (*config, error) {
+	cfg := &config{}
+	if filename == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.compile(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// compile validates a decoded config and compiles its rules.
+func (cfg *config) compile() error {
+	var err error
+	if cfg.trustedProxies, err = parseCIDRs(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	for id, tc := range cfg.Tenants {
+		if err := tc.Validate(); err != nil {
+			return fmt.Errorf("tenant %s: %v", id, err)
+		}
+		if err := aggate.CompileRelabelConfigs(tc.RelabelConfigs); err != nil {
+			return fmt.Errorf("tenant %s: %v", id, err)
+		}
+	}
+	for path, pc := range cfg.PushPaths {
+		if err := aggate.CompileRelabelConfigs(pc.RelabelConfigs); err != nil {
+			return fmt.Errorf("push path %s: %v", path, err)
+		}
+	}
+	if cfg.Schema != nil {
+		if err := cfg.Schema.Compile(); err != nil {
+			return fmt.Errorf("schema: %v", err)
+		}
+	}
+	if err := cfg.Normalize.Compile(); err != nil {
+		return fmt.Errorf("normalize: %v", err)
+	}
+	if cfg.Inject != nil {
+		cfg.Inject.trustedProxies = cfg.trustedProxies
+		if err := cfg.Inject.compile(); err != nil {
+			return fmt.Errorf("inject: %v", err)
+		}
+	}
+	if cfg.UserAgent != nil {
+		if err := cfg.UserAgent.compile(); err != nil {
+			return fmt.Errorf("user_agent: %v", err)
+		}
+	}
+	if cfg.GeoIP != nil {
+		cfg.GeoIP.trustedProxies = cfg.trustedProxies
+		if err := cfg.GeoIP.compile(); err != nil {
+			return fmt.Errorf("geoip: %v", err)
+		}
+	}
+	return nil
+}
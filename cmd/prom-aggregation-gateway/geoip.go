@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+// Labels geoIPConfig can attach.
+const (
+	geoCountry   = "country"
+	geoContinent = "continent"
+)
+
+// geoIPConfig resolves the client IP of each push in a local MaxMind
+// database, and attaches country and continent labels to the configured
+// families.  The database is reloaded when it changes on disk.
+type geoIPConfig struct {
+	Database string   `json:"database"`
+	Families []string `json:"families"`
+	// Labels lists which of country and continent to attach; both if empty.
+	Labels []string `json:"labels"`
+	// PrivateValue is used for private, loopback and link-local IPs;
+	// "private" if unset.
+	PrivateValue string `json:"private_value"`
+	// UnknownValue is used for IPs not in the database; "unknown" if unset.
+	UnknownValue string `json:"unknown_value"`
+	// ReloadInterval is how often to check the database for changes; "1m"
+	// if unset.
+	ReloadInterval string `json:"reload_interval"`
+
+	families map[string]struct{}
+	labels   []*injectLabel
+	// trustedProxies is the config's top-level trusted_proxies.
+	trustedProxies []*net.IPNet
+	reloadInterval time.Duration
+
+	lock    sync.RWMutex
+	reader  *mmdbReader
+	modTime time.Time
+	size    int64
+}
+
+func (c *geoIPConfig) compile() error {
+	if c.Database == "" {
+		return fmt.Errorf("database must be given")
+	}
+	c.families = make(map[string]struct{}, len(c.Families))
+	for _, name := range c.Families {
+		c.families[name] = struct{}{}
+	}
+	if len(c.Labels) == 0 {
+		c.Labels = []string{geoCountry, geoContinent}
+	}
+	for _, l := range c.Labels {
+		switch l {
+		case geoCountry, geoContinent:
+		default:
+			return fmt.Errorf("Unknown GeoIP label %q", l)
+		}
+		c.labels = append(c.labels, &injectLabel{Label: l, OnConflict: conflictOverride})
+	}
+	if c.PrivateValue == "" {
+		c.PrivateValue = "private"
+	}
+	if c.UnknownValue == "" {
+		c.UnknownValue = "unknown"
+	}
+	if c.ReloadInterval == "" {
+		c.ReloadInterval = "1m"
+	}
+
+	var err error
+	if c.reloadInterval, err = time.ParseDuration(c.ReloadInterval); err != nil {
+		return err
+	}
+	if c.reloadInterval <= 0 {
+		return fmt.Errorf("reload_interval must be positive")
+	}
+	_, err = c.reload()
+	return err
+}
+
+// reload reads the database if it has changed since it was last read, and
+// reports whether it did.
+func (c *geoIPConfig) reload() (bool, error) {
+	fi, err := os.Stat(c.Database)
+	if err != nil {
+		return false, err
+	}
+	c.lock.RLock()
+	unchanged := c.reader != nil && fi.ModTime().Equal(c.modTime) && fi.Size() == c.size
+	c.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	buf, err := ioutil.ReadFile(c.Database)
+	if err != nil {
+		return false, err
+	}
+	reader, err := newMMDBReader(buf)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", c.Database, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reader, c.modTime, c.size = reader, fi.ModTime(), fi.Size()
+	return true, nil
+}
+
+// watch reloads the database whenever it changes.  It never returns.
+func (c *geoIPConfig) watch() {
+	for range time.Tick(c.reloadInterval) {
+		if reloaded, err := c.reload(); err != nil {
+			log.Printf("Error reloading GeoIP database: %v", err)
+		} else if reloaded {
+			log.Printf("Reloaded GeoIP database %s", c.Database)
+		}
+	}
+}
+
+// locate returns the country and continent codes for an IP.
+func (c *geoIPConfig) locate(addr string) (country, continent string) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return c.UnknownValue, c.UnknownValue
+	}
+	if isPrivateIP(ip) {
+		return c.PrivateValue, c.PrivateValue
+	}
+
+	c.lock.RLock()
+	reader := c.reader
+	c.lock.RUnlock()
+	record, err := reader.lookup(ip)
+	if err != nil {
+		log.Printf("Error looking up %s in GeoIP database: %v", addr, err)
+	}
+
+	country, continent = c.UnknownValue, c.UnknownValue
+	if m, ok := record.(map[string]interface{}); ok {
+		if code, ok := lookupString(m, "country", "iso_code"); ok {
+			country = code
+		}
+		if code, ok := lookupString(m, "continent", "code"); ok {
+			continent = code
+		}
+	}
+	return country, continent
+}
+
+func lookupString(m map[string]interface{}, outer, inner string) (string, bool) {
+	o, ok := m[outer].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	s, ok := o[inner].(string)
+	return s, ok && s != ""
+}
+
+// privateNetworks are the RFC 1918 and RFC 4193 (unique local) ranges,
+// checked by hand as net.IP.IsPrivate needs Go 1.17.
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// transform returns a transform attaching the location of r's client to the
+// configured families, replacing any labels of the same name the client
+// sent.
+func (c *geoIPConfig) transform(r *http.Request) aggate.Transform {
+	return func(families map[string]*dto.MetricFamily) error {
+		if c == nil {
+			return nil
+		}
+		var values map[string]string
+		for name, family := range families {
+			if _, ok := c.families[name]; !ok {
+				continue
+			}
+			if values == nil {
+				country, continent := c.locate(clientIP(r, c.trustedProxies))
+				values = map[string]string{geoCountry: country, geoContinent: continent}
+			}
+			if err := injectFamily(family, c.labels, func(i int) string { return values[c.labels[i].Label] }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
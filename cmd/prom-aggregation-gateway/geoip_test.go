@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+const testGeoIPDatabase = "testdata/synthetic-country.mmdb"
+
+func TestGeoIPLocate(t *testing.T) {
+	c := &geoIPConfig{Database: testGeoIPDatabase}
+	if err := c.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ip, country, continent string
+	}{
+		{"81.2.69.142", "GB", "EU"},
+		{"89.160.20.112", "SE", "EU"},
+		{"216.160.83.56", "US", "NA"},
+		{"175.16.199.1", "CN", "AS"},
+		{"202.196.224.1", "unknown", "AS"},
+		{"2a02:cf40::1", "DE", "EU"},
+		{"8.8.8.8", "unknown", "unknown"},
+		{"2001:4860::8888", "unknown", "unknown"},
+		{"10.1.2.3", "private", "private"},
+		{"127.0.0.1", "private", "private"},
+		{"fd00::1", "private", "private"},
+		{"not an ip", "unknown", "unknown"},
+	} {
+		country, continent := c.locate(tc.ip)
+		if country != tc.country || continent != tc.continent {
+			t.Errorf("%s: expected %s/%s, got %s/%s", tc.ip, tc.country, tc.continent, country, continent)
+		}
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"172.31.255.255":  true,
+		"172.32.0.1":      false,
+		"192.168.1.1":     true,
+		"192.169.1.1":     false,
+		"127.0.0.1":       true,
+		"169.254.1.1":     true,
+		"0.0.0.0":         true,
+		"fc00::1":         true,
+		"fdff::1":         true,
+		"fe80::1":         true,
+		"::1":             true,
+		"::ffff:10.0.0.1": true,
+		"8.8.8.8":         false,
+		"2001:4860::8888": false,
+	} {
+		if have := isPrivateIP(net.ParseIP(ip)); have != want {
+			t.Errorf("%s: expected %v, got %v", ip, want, have)
+		}
+	}
+}
+
+func TestGeoIPLabels(t *testing.T) {
+	var cfg config
+	if err := json.Unmarshal([]byte(`{
+  "trusted_proxies": ["10.0.0.0/8"],
+  "geoip": {
+    "database": "`+testGeoIPDatabase+`",
+    "families": ["ui_page_render_errors"]
+  }
+}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	c := cfg.GeoIP
+	r := httptest.NewRequest("POST", "http://example.com/metrics/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "81.2.69.142")
+
+	a := aggate.New(aggate.Options{})
+	if err := a.Push(strings.NewReader(labelFields2), c.transform(r)); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{continent="EU",country="GB",path="/prom/:orgId"} 1
+`
+	if have := scrape(a.ScrapeHandler(), "/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+}
+
+func TestGeoIPReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf, err := ioutil.ReadFile(testGeoIPDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := filepath.Join(dir, "test.mmdb")
+	if err := ioutil.WriteFile(database, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &geoIPConfig{Database: database}
+	if err := c.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := c.reload(); err != nil || reloaded {
+		t.Fatalf("Expected no reload of unchanged database, got %v, %v", reloaded, err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(database, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := c.reload(); err != nil || !reloaded {
+		t.Fatalf("Expected reload of changed database, got %v, %v", reloaded, err)
+	}
+
+	if err := ioutil.WriteFile(database, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.reload(); err == nil {
+		t.Fatal("Expected error reloading corrupt database")
+	}
+	if country, _ := c.locate("81.2.69.142"); country != "GB" {
+		t.Fatalf("Expected the previous database to stay in use, got %s", country)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+const (
+	// Sources of injected label values.
+	fromHeader   = "header"
+	fromClientIP = "client_ip"
+	fromOrigin   = "origin"
+	fromJWTClaim = "jwt_claim"
+
+	// What to do when the client already sent the injected label.
+	conflictOverride = "override"
+	conflictReject   = "reject"
+	conflictKeep     = "keep"
+)
+
+// injectConfig adds labels derived from the push request to every pushed
+// series, so they can be trusted in a way client-supplied labels cannot.
+type injectConfig struct {
+	Labels []*injectLabel `json:"labels"`
+	JWT    *jwtConfig     `json:"jwt"`
+
+	// trustedProxies is the config's top-level trusted_proxies.
+	trustedProxies []*net.IPNet
+}
+
+type injectLabel struct {
+	Label string `json:"label"`
+	From  string `json:"from"`
+	// Header names the header to use when From is "header".
+	Header string `json:"header"`
+	// Claim names the claim to use when From is "jwt_claim".
+	Claim string `json:"claim"`
+	// OnConflict is one of "override" (the default), "reject" or "keep".
+	OnConflict string `json:"on_conflict"`
+}
+
+// jwtConfig says how to verify the JWT that claims are taken from.
+type jwtConfig struct {
+	// Header carries the token, as "Bearer <token>".  Defaults to
+	// Authorization.
+	Header string `json:"header"`
+	// Exactly one of HMACSecret (for HS256) or RSAPublicKeyFile (for
+	// RS256) must be given.
+	HMACSecret       string `json:"hmac_secret"`
+	RSAPublicKeyFile string `json:"rsa_public_key_file"`
+
+	rsaPublicKey *rsa.PublicKey
+}
+
+func (c *injectConfig) compile() error {
+	for _, l := range c.Labels {
+		if !model.LabelName(l.Label).IsValid() {
+			return fmt.Errorf("Invalid label name %q", l.Label)
+		}
+		switch l.From {
+		case fromHeader:
+			if l.Header == "" {
+				return fmt.Errorf("Label %s: header must be given", l.Label)
+			}
+		case fromJWTClaim:
+			if l.Claim == "" {
+				return fmt.Errorf("Label %s: claim must be given", l.Label)
+			}
+			if c.JWT == nil {
+				return fmt.Errorf("Label %s: jwt must be configured", l.Label)
+			}
+		case fromClientIP, fromOrigin:
+		default:
+			return fmt.Errorf("Label %s: unknown source %q", l.Label, l.From)
+		}
+		switch l.OnConflict {
+		case "":
+			l.OnConflict = conflictOverride
+		case conflictOverride, conflictReject, conflictKeep:
+		default:
+			return fmt.Errorf("Label %s: unknown conflict policy %q", l.Label, l.OnConflict)
+		}
+	}
+
+	if c.JWT != nil {
+		return c.JWT.compile()
+	}
+	return nil
+}
+
+// headers returns the request headers labels are injected from.
+func (c *injectConfig) headers() []string {
+	if c == nil {
+		return nil
+	}
+	var headers []string
+	for _, l := range c.Labels {
+		if l.From == fromHeader {
+			headers = append(headers, l.Header)
+		}
+	}
+	if c.JWT != nil {
+		headers = append(headers, c.JWT.Header)
+	}
+	return headers
+}
+
+func (c *jwtConfig) compile() error {
+	if c.Header == "" {
+		c.Header = "Authorization"
+	}
+	if (c.HMACSecret == "") == (c.RSAPublicKeyFile == "") {
+		return fmt.Errorf("Exactly one of jwt hmac_secret and rsa_public_key_file must be given")
+	}
+	if c.RSAPublicKeyFile == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(c.RSAPublicKeyFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return fmt.Errorf("No PEM data in %s", c.RSAPublicKeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s is not an RSA public key", c.RSAPublicKeyFile)
+	}
+	c.rsaPublicKey = rsaKey
+	return nil
+}
+
+// transform returns a transform injecting the configured labels, with
+// values taken from r.
+func (c *injectConfig) transform(r *http.Request) aggate.Transform {
+	return func(families map[string]*dto.MetricFamily) error {
+		if c == nil || len(c.Labels) == 0 {
+			return nil
+		}
+
+		var claims map[string]interface{}
+		values := make([]string, len(c.Labels))
+		for i, l := range c.Labels {
+			switch l.From {
+			case fromHeader:
+				values[i] = r.Header.Get(l.Header)
+			case fromClientIP:
+				values[i] = clientIP(r, c.trustedProxies)
+			case fromOrigin:
+				if u, err := url.Parse(r.Header.Get("Origin")); err == nil {
+					values[i] = u.Hostname()
+				}
+			case fromJWTClaim:
+				if claims == nil {
+					var err error
+					if claims, err = c.JWT.claims(r); err != nil {
+						return err
+					}
+				}
+				if v, ok := claims[l.Claim]; ok && v != nil {
+					values[i] = fmt.Sprint(v)
+				}
+			}
+		}
+
+		for _, family := range families {
+			if err := injectFamily(family, c.Labels, func(i int) string { return values[i] }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// injectFamily sets labels on every series of family, labels[i] to
+// value(i), and merges the series this makes identical, as when an
+// overriding label replaces the only label telling them apart.
+func injectFamily(family *dto.MetricFamily, labels []*injectLabel, value func(i int) string) error {
+	for _, m := range family.Metric {
+		for i, l := range labels {
+			if err := injectLabelPair(m, l, value(i)); err != nil {
+				return fmt.Errorf("Metric '%s': %v", family.GetName(), err)
+			}
+		}
+	}
+	return aggate.MergeDuplicates(family)
+}
+
+// injectLabelPair sets the label l to value on m, according to the conflict
+// policy.  An empty value means the label is absent.
+func injectLabelPair(m *dto.Metric, l *injectLabel, value string) error {
+	for i, p := range m.Label {
+		if p.GetName() != l.Label {
+			continue
+		}
+		switch l.OnConflict {
+		case conflictReject:
+			return fmt.Errorf("label '%s' may not be pushed", l.Label)
+		case conflictKeep:
+			return nil
+		}
+		if value == "" {
+			m.Label = append(m.Label[:i], m.Label[i+1:]...)
+		} else {
+			p.Value = &value
+		}
+		return nil
+	}
+
+	if value != "" {
+		name := l.Label
+		m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	return nil
+}
+
+// clientIP returns the IP of the client making the request.  If it came via
+// trusted proxies, this is the rightmost untrusted address in
+// X-Forwarded-For.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(host, trusted) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ipnets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return ipnets, nil
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// claims verifies the request's JWT and returns its claims.  A request
+// without a token has no claims.
+func (c *jwtConfig) claims(r *http.Request) (map[string]interface{}, error) {
+	token := strings.TrimPrefix(r.Header.Get(c.Header), "Bearer ")
+	if token == "" {
+		return map[string]interface{}{}, nil
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid JWT: malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWT: %v", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && c.HMACSecret != "":
+		mac := hmac.New(sha256.New, []byte(c.HMACSecret))
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("Invalid JWT: bad signature")
+		}
+	case header.Alg == "RS256" && c.rsaPublicKey != nil:
+		hash := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(c.rsaPublicKey, crypto.SHA256, hash[:], sig); err != nil {
+			return nil, fmt.Errorf("Invalid JWT: bad signature")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid JWT: unexpected algorithm %q", header.Alg)
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Now().Unix() > int64(exp) {
+		return nil, fmt.Errorf("Invalid JWT: expired")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("Invalid JWT: %v", err)
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("Invalid JWT: %v", err)
+	}
+	return nil
+}
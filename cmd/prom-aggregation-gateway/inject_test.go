@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+func hs256Token(secret, claims string) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestInject(t *testing.T) {
+	var cfg config
+	if err := json.Unmarshal([]byte(`{
+  "trusted_proxies": ["10.0.0.0/8"],
+  "inject": {
+    "labels": [
+      {"label": "version", "from": "header", "header": "X-App-Version"},
+      {"label": "ip", "from": "client_ip", "on_conflict": "reject"},
+      {"label": "origin", "from": "origin", "on_conflict": "keep"},
+      {"label": "region", "from": "jwt_claim", "claim": "region"}
+    ],
+    "jwt": {"hmac_secret": "sekrit"}
+  }
+}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	c := cfg.Inject
+
+	for _, tc := range []struct {
+		in      string
+		headers map[string]string
+		want    string
+		err     string
+	}{
+		{
+			in: multilabel1,
+			headers: map[string]string{
+				"X-App-Version":   "1.2.3",
+				"X-Forwarded-For": "192.0.2.1, 10.0.0.2",
+				"Origin":          "https://app.example.com:8080",
+				"Authorization":   "Bearer " + hs256Token("sekrit", `{"region":"eu"}`),
+			},
+			want: `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b",ip="192.0.2.1",origin="app.example.com",region="eu",version="1.2.3"} 1
+`,
+		},
+		{
+			in: `# HELP counter A counter
+# TYPE counter counter
+counter{origin="spoofed",version="spoofed"} 1
+`,
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			want: `# HELP counter A counter
+# TYPE counter counter
+counter{ip="10.0.0.1",origin="spoofed"} 1
+`,
+		},
+		{
+			// Series differing only in an overridden label are merged.
+			in: `# HELP counter A counter
+# TYPE counter counter
+counter{region="eu"} 1
+counter{region="us"} 2
+`,
+			headers: map[string]string{"Authorization": "Bearer " + hs256Token("sekrit", `{"region":"eu"}`)},
+			want: `# HELP counter A counter
+# TYPE counter counter
+counter{ip="10.0.0.1",region="eu"} 3
+`,
+		},
+		{
+			in: `# HELP counter A counter
+# TYPE counter counter
+counter{ip="127.0.0.1"} 1
+`,
+			err: `Metric 'counter': label 'ip' may not be pushed`,
+		},
+		{
+			in:      multilabel1,
+			headers: map[string]string{"Authorization": "Bearer " + hs256Token("wrong", `{"region":"eu"}`)},
+			err:     `Invalid JWT: bad signature`,
+		},
+	} {
+		r := httptest.NewRequest("POST", "http://example.com/metrics/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+
+		a := aggate.New(aggate.Options{})
+		err := a.Push(strings.NewReader(tc.in), c.transform(r))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("Expected %s, got %v", tc.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if have := scrape(a.ScrapeHandler(), "/metrics", "", ""); have != tc.want {
+			t.Fatalf("Expected:\n%s\ngot:\n%s", tc.want, have)
+		}
+	}
+}
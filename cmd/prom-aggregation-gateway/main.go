@@ -2,261 +2,17 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"sort"
-	"sync"
+	"runtime"
+	"time"
 
-	dto "github.com/prometheus/client_model/go"
-	"github.com/prometheus/common/expfmt"
-	"github.com/prometheus/common/model"
-)
-
-func lablesLessThan(a, b []*dto.LabelPair) bool {
-	i, j := 0, 0
-	for i < len(a) && j < len(b) {
-		if *a[i].Name != *b[j].Name {
-			return *a[i].Name < *b[j].Name
-		}
-		if *a[i].Value != *b[j].Value {
-			return *a[i].Value < *b[j].Value
-		}
-		i++
-		j++
-	}
-	return len(a) < len(b)
-}
-
-type byLabel []*dto.Metric
-
-func (a byLabel) Len() int           { return len(a) }
-func (a byLabel) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byLabel) Less(i, j int) bool { return lablesLessThan(a[i].Label, a[j].Label) }
-
-// Sort a slice of LabelPairs by name
-type byName []*dto.LabelPair
-
-func (a byName) Len() int           { return len(a) }
-func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byName) Less(i, j int) bool { return a[i].GetName() < a[j].GetName() }
-
-func uint64ptr(a uint64) *uint64 {
-	return &a
-}
-
-func float64ptr(a float64) *float64 {
-	return &a
-}
-
-func mergeBuckets(a, b []*dto.Bucket) []*dto.Bucket {
-	output := []*dto.Bucket{}
-	i, j := 0, 0
-	for i < len(a) && j < len(b) {
-		if *a[i].UpperBound < *b[j].UpperBound {
-			output = append(output, a[i])
-			i++
-		} else if *a[i].UpperBound > *b[j].UpperBound {
-			output = append(output, b[j])
-			j++
-		} else {
-			output = append(output, &dto.Bucket{
-				CumulativeCount: uint64ptr(*a[i].CumulativeCount + *b[j].CumulativeCount),
-				UpperBound:      a[i].UpperBound,
-			})
-			i++
-			j++
-		}
-	}
-	for ; i < len(a); i++ {
-		output = append(output, a[i])
-	}
-	for ; j < len(b); j++ {
-		output = append(output, b[j])
-	}
-	return output
-}
-
-func mergeMetric(ty dto.MetricType, a, b *dto.Metric) *dto.Metric {
-	switch ty {
-	case dto.MetricType_COUNTER:
-		return &dto.Metric{
-			Label: a.Label,
-			Counter: &dto.Counter{
-				Value: float64ptr(*a.Counter.Value + *b.Counter.Value),
-			},
-		}
-
-	case dto.MetricType_GAUGE:
-		// No very meaninful way for us to merge gauges.  We'll sum them
-		// and clear out any gauges on scrape, as a best approximation, but
-		// this relies on client pushing with the same interval as we scrape.
-		return &dto.Metric{
-			Label: a.Label,
-			Gauge: &dto.Gauge{
-				Value: float64ptr(*a.Gauge.Value + *b.Gauge.Value),
-			},
-		}
-
-	case dto.MetricType_HISTOGRAM:
-		return &dto.Metric{
-			Label: a.Label,
-			Histogram: &dto.Histogram{
-				SampleCount: uint64ptr(*a.Histogram.SampleCount + *b.Histogram.SampleCount),
-				SampleSum:   float64ptr(*a.Histogram.SampleSum + *b.Histogram.SampleSum),
-				Bucket:      mergeBuckets(a.Histogram.Bucket, b.Histogram.Bucket),
-			},
-		}
-
-	case dto.MetricType_UNTYPED:
-		return &dto.Metric{
-			Label: a.Label,
-			Untyped: &dto.Untyped{
-				Value: float64ptr(*a.Untyped.Value + *b.Untyped.Value),
-			},
-		}
-
-	case dto.MetricType_SUMMARY:
-		// No way of merging summaries, abort.
-		return nil
-	}
-
-	return nil
-}
-
-func mergeFamily(a, b *dto.MetricFamily) (*dto.MetricFamily, error) {
-	if *a.Type != *b.Type {
-		return nil, fmt.Errorf("Cannot merge metric '%s': type %s != %s",
-			*a.Name, a.Type.String(), b.Type.String())
-	}
-
-	output := &dto.MetricFamily{
-		Name: a.Name,
-		Help: a.Help,
-		Type: a.Type,
-	}
-
-	i, j := 0, 0
-	for i < len(a.Metric) && j < len(b.Metric) {
-		if lablesLessThan(a.Metric[i].Label, b.Metric[j].Label) {
-			output.Metric = append(output.Metric, a.Metric[i])
-			i++
-		} else if lablesLessThan(b.Metric[j].Label, a.Metric[i].Label) {
-			output.Metric = append(output.Metric, b.Metric[j])
-			j++
-		} else {
-			merged := mergeMetric(*a.Type, a.Metric[i], b.Metric[j])
-			if merged != nil {
-				output.Metric = append(output.Metric, merged)
-			}
-			i++
-			j++
-		}
-	}
-	for ; i < len(a.Metric); i++ {
-		output.Metric = append(output.Metric, a.Metric[i])
-	}
-	for ; j < len(b.Metric); j++ {
-		output.Metric = append(output.Metric, b.Metric[j])
-	}
-	return output, nil
-}
-
-type aggate struct {
-	familiesLock sync.RWMutex
-	families     map[string]*dto.MetricFamily
-}
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-func newAggate() *aggate {
-	return &aggate{
-		families: map[string]*dto.MetricFamily{},
-	}
-}
-
-func validateFamily(f *dto.MetricFamily) error {
-	// Map of fingerprints we've seen before in this family
-	fingerprints := make(map[model.Fingerprint]struct{}, len(f.Metric))
-	for _, m := range f.Metric {
-		// Turn protobuf LabelSet into Prometheus model LabelSet
-		lset := make(model.LabelSet, len(m.Label)+1)
-		for _, p := range m.Label {
-			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-		}
-		lset[model.MetricNameLabel] = model.LabelValue(f.GetName())
-		if err := lset.Validate(); err != nil {
-			return err
-		}
-		fingerprint := lset.Fingerprint()
-		if _, found := fingerprints[fingerprint]; found {
-			return fmt.Errorf("Duplicate labels: %v", lset)
-		}
-		fingerprints[fingerprint] = struct{}{}
-	}
-	return nil
-}
-
-func (a *aggate) parseAndMerge(r io.Reader) error {
-	var parser expfmt.TextParser
-	inFamilies, err := parser.TextToMetricFamilies(r)
-	if err != nil {
-		return err
-	}
-
-	a.familiesLock.Lock()
-	defer a.familiesLock.Unlock()
-	for name, family := range inFamilies {
-		// Sort labels in case source sends them inconsistently
-		for _, m := range family.Metric {
-			sort.Sort(byName(m.Label))
-		}
-
-		if err := validateFamily(family); err != nil {
-			return err
-		}
-
-		// family must be sorted for the merge
-		sort.Sort(byLabel(family.Metric))
-
-		existingFamily, ok := a.families[name]
-		if !ok {
-			a.families[name] = family
-			continue
-		}
-
-		merged, err := mergeFamily(existingFamily, family)
-		if err != nil {
-			return err
-		}
-
-		a.families[name] = merged
-	}
-
-	return nil
-}
-
-func (a *aggate) handler(w http.ResponseWriter, r *http.Request) {
-	contentType := expfmt.Negotiate(r.Header)
-	w.Header().Set("Content-Type", string(contentType))
-	enc := expfmt.NewEncoder(w, contentType)
-
-	a.familiesLock.RLock()
-	defer a.familiesLock.RUnlock()
-	metricNames := []string{}
-	for name := range a.families {
-		metricNames = append(metricNames, name)
-	}
-	sort.Sort(sort.StringSlice(metricNames))
-
-	for _, name := range metricNames {
-		if err := enc.Encode(a.families[name]); err != nil {
-			http.Error(w, "An error has occurred during metrics encoding:\n\n"+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// TODO reset gauges
-}
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
 
 func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
@@ -268,19 +24,112 @@ func main() {
 	listen := flag.String("listen", ":80", "Address and port to listen on.")
 	cors := flag.String("cors", "*", "The 'Access-Control-Allow-Origin' value to be returned.")
 	pushPath := flag.String("push-path", "/metrics/", "HTTP path to accept pushed metrics.")
+	configFile := flag.String("config", "", "Optional JSON configuration file.")
+	tenantHeader := flag.String("tenant-header", "", "HTTP header carrying the tenant ID, e.g. X-Scope-OrgID. Enables multi-tenancy.")
+	tenantFromPath := flag.Bool("tenant-from-path", false, "Take the tenant ID from the first path segment after -push-path. Enables multi-tenancy.")
+	maxTenants := flag.Int("max-tenants", 1000, "Maximum number of tenants not named in the config file; pushes from further tenants are refused with 429 (0 for no limit).")
+	configuredTenantsOnly := flag.Bool("configured-tenants-only", false, "Refuse pushes from tenants not named in the config file with 403.")
+	tenantLabel := flag.String("tenant-label", "", "If set, expose every tenant on /metrics with this label holding the tenant ID.")
+	idempotencySize := flag.Int("idempotency-keys", 10000, "Number of recent Idempotency-Keys to remember per tenant (0 to ignore Idempotency-Keys).")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 10*time.Minute, "How long to remember an Idempotency-Key.")
+	timestamps := flag.String("timestamps", aggate.TimestampsStrip, "What to do with pushed sample timestamps: 'strip' them, 'reject' the push, or keep the 'newest' of each merged series.")
+	inferNames := flag.String("infer-types", "", "Comma-separated ways to type untyped families: total-suffix (*_total are counters), schema, existing (match the stored family), or 'all'.")
+	helpPolicy := flag.String("help-policy", aggate.HelpFirst, "Which HELP a family keeps when pushes differ: 'first', 'last', 'most-common', or 'config' (from the config file's help section, else first).")
+	queueSize := flag.Int("merge-queue", 0, "If set, answer pushes with 202 once parsed, and merge them in the background from a queue of this size.")
+	mergeWorkers := flag.Int("merge-workers", runtime.NumCPU(), "Number of goroutines merging queued pushes.")
+	selfMetrics := flag.Bool("scrape-self-metrics", false, "Also serve the gateway's own metrics (otherwise only on /-/metrics) on /metrics, alongside the aggregated metrics.")
+	checkNames := flag.String("sample-checks", "", "Comma-separated checks rejecting pushes with suspect samples: negative-counters, nan-values, decreasing-buckets, inf-bucket-count, missing-inf-bucket, or 'all'.")
+	var defaults aggate.Limits
+	flag.IntVar(&defaults.MaxFamilies, "max-families", 0, "Maximum number of metric families per tenant (0 for no limit).")
+	flag.IntVar(&defaults.MaxSeries, "max-series", 0, "Maximum number of series per tenant (0 for no limit).")
+	flag.IntVar(&defaults.MaxSeriesPerFamily, "max-series-per-family", 0, "Maximum number of series per metric family (0 for no limit).")
+	flag.IntVar(&defaults.MaxLabelValuesPerLabel, "max-label-values", 0, "Maximum number of values per label name within a metric family (0 for no limit).")
+	memorySoftLimit := flag.Int64("memory-soft-limit", 0, "Approximate bytes of stored series above which pushes adding series are refused (0 for no limit).")
+	memoryHardLimit := flag.Int64("memory-hard-limit", 0, "Approximate bytes of stored series above which the least recently updated series are evicted (0 for no limit).")
+	var pl aggate.PushLimits
+	flag.Int64Var(&pl.MaxBytes, "max-push-bytes", 0, "Maximum size of a push body, larger pushes are refused with 413 (0 for no limit).")
+	flag.IntVar(&pl.MaxFamilies, "max-push-families", 0, "Maximum number of metric families in a single push (0 for no limit).")
+	flag.IntVar(&pl.MaxSeries, "max-push-series", 0, "Maximum number of series in a single push (0 for no limit).")
+	flag.IntVar(&pl.MaxLabels, "max-labels-per-series", 0, "Maximum number of labels on a pushed series (0 for no limit).")
+	flag.IntVar(&pl.MaxNameLength, "max-name-length", 0, "Maximum length in bytes of pushed metric and label names (0 for no limit).")
+	flag.IntVar(&pl.MaxValueLength, "max-label-value-length", 0, "Maximum length in bytes of pushed label values (0 for no limit).")
+	flag.StringVar(&defaults.Policy, "limit-policy", aggate.PolicyReject, "What to do with new series exceeding a limit: 'reject' the push with 429, or 'drop' the series.")
 	flag.Parse()
 
-	a := newAggate()
-	http.HandleFunc("/metrics", a.handler)
+	if err := defaults.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := aggate.ValidateTimestampPolicy(*timestamps); err != nil {
+		log.Fatal(err)
+	}
+	if err := aggate.ValidateHelpPolicy(*helpPolicy); err != nil {
+		log.Fatal(err)
+	}
+	checks, err := aggate.ParseSampleChecks(*checkNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	inference, err := aggate.ParseTypeInference(*inferNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	t := newTenants(defaults, cfg.Tenants)
+	t.options = aggate.Options{
+		Schema:          cfg.Schema,
+		Normalize:       cfg.Normalize,
+		Checks:          checks,
+		Timestamps:      *timestamps,
+		Inference:       inference,
+		HelpPolicy:      *helpPolicy,
+		ConfigHelp:      cfg.Help,
+		PushLimits:      pl,
+		Memory:          aggate.NewMemoryTracker(*memorySoftLimit, *memoryHardLimit),
+		Metrics:         aggate.NewMetrics(),
+		IdempotencySize: *idempotencySize,
+		IdempotencyTTL:  *idempotencyTTL,
+	}
+	prometheus.MustRegister(t.options.Memory, t.options.Metrics)
+	if *memoryHardLimit > 0 {
+		go t.options.Memory.Watch()
+	}
+	if *queueSize > 0 {
+		t.options.Queue = aggate.NewMergeQueue(*queueSize, *mergeWorkers)
+		prometheus.MustRegister(t.options.Queue)
+	}
+	t.inject = cfg.Inject
+	t.userAgent = cfg.UserAgent
+	t.geoIP = cfg.GeoIP
+	if cfg.GeoIP != nil {
+		go cfg.GeoIP.watch()
+	}
+	t.header = *tenantHeader
+	t.fromPath = *tenantFromPath
+	t.label = *tenantLabel
+	t.maxTenants = *maxTenants
+	t.configuredOnly = *configuredTenantsOnly
+	if *selfMetrics {
+		t.gatherers = prometheus.Gatherers{prometheus.DefaultGatherer}
+	}
+
+	prometheus.MustRegister(t)
+
+	http.HandleFunc("/metrics", t.handler)
+	http.HandleFunc(tenantsPath, t.tenantHandler)
+	http.HandleFunc("/api/v1/metadata", t.metadataHandler)
 	http.HandleFunc("/-/healthy", handleHealthCheck)
 	http.HandleFunc("/-/ready", handleHealthCheck)
-	http.HandleFunc(*pushPath, func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", *cors)
-		if err := a.parseAndMerge(r.Body); err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+	http.Handle("/-/metrics", promhttp.Handler())
+	http.HandleFunc(*pushPath, t.pushHandler(*pushPath, *cors, cfg.PushPaths[*pushPath].RelabelConfigs))
+	for path, pc := range cfg.PushPaths {
+		if path != *pushPath {
+			http.HandleFunc(path, t.pushHandler(path, *cors, pc.RelabelConfigs))
 		}
-	})
+	}
 	log.Fatal(http.ListenAndServe(*listen, nil))
 }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+)
+
+// This is a minimal reader for the MaxMind DB format used by GeoIP2 and
+// GeoLite2 databases, as described at
+// https://maxmind.github.io/MaxMind-DB/.  It supports lookups and decoding
+// of the data section into maps, slices and scalars, which is all the GeoIP
+// enrichment needs.
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const mmdbDataSeparator = 16
+
+type mmdbReader struct {
+	buf        []byte
+	data       []byte // Data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // Node at which IPv4 lookups start in an IPv6 tree
+	metadata   map[string]interface{}
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("Not a MaxMind DB: no metadata")
+	}
+	metadataStart := i + len(mmdbMetadataMarker)
+	d := mmdbDecoder{buf: buf[metadataStart:]}
+	m, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid MaxMind DB metadata: %v", err)
+	}
+	metadata, ok := m.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid MaxMind DB metadata")
+	}
+
+	r := &mmdbReader{buf: buf, metadata: metadata}
+	r.nodeCount, _ = toUint(metadata["node_count"])
+	r.recordSize, _ = toUint(metadata["record_size"])
+	r.ipVersion, _ = toUint(metadata["ip_version"])
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("Unsupported MaxMind DB record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("Unsupported MaxMind DB IP version %d", r.ipVersion)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(i) {
+		return nil, fmt.Errorf("Invalid MaxMind DB: search tree larger than file")
+	}
+	r.data = buf[treeSize+mmdbDataSeparator : i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a node.
+func (r *mmdbReader) readNode(node, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the data for ip, or nil if the database has none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	} else if node < r.nodeCount {
+		return nil, fmt.Errorf("Invalid MaxMind DB: search tree too deep")
+	}
+
+	offset := node - r.nodeCount - mmdbDataSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, fmt.Errorf("Invalid MaxMind DB: data pointer out of range")
+	}
+	d := mmdbDecoder{buf: r.data}
+	v, _, err := d.decode(offset)
+	return v, err
+}
+
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) byteAt(offset uint) (byte, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	return d.buf[offset], nil
+}
+
+func (d *mmdbDecoder) bytes(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) {
+		return nil, fmt.Errorf("unexpected end of data")
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+// decode decodes the field at offset, returning it and the offset of the
+// next field.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	ctrl, err := d.byteAt(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		ss, vvv := uint(ctrl>>3)&0x3, uint(ctrl&0x7)
+		b, err := d.bytes(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pointer uint
+		switch ss {
+		case 0:
+			pointer = vvv<<8 | uint(b[0])
+		case 1:
+			pointer = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			pointer = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		case 3:
+			pointer = uint(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := d.decode(pointer)
+		return v, offset + ss + 1, err
+	}
+
+	if typ == mmdbExtended {
+		next, err := d.byteAt(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(next)
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		case 3:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == mmdbInt32 {
+			return int32(v), offset, nil
+		}
+		return v, offset, nil
+	case mmdbUint128:
+		return append([]byte(nil), b...), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+func toUint(v interface{}) (uint, bool) {
+	u, ok := v.(uint64)
+	return uint(u), ok
+}
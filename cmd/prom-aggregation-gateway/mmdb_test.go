@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMMDBDecode checks the decoder against the test vectors of MaxMind's
+// reference Go reader, github.com/oschwald/maxminddb-golang, so that it isn't
+// only tested against databases written by testdata/mkgeoip.go.
+func TestMMDBDecode(t *testing.T) {
+	vectors := map[string]interface{}{
+		// Booleans
+		"0007": false,
+		"0107": true,
+
+		// Doubles
+		"680000000000000000": 0.0,
+		"683FE0000000000000": 0.5,
+		"68400921FB54442EEA": 3.14159265359,
+		"68405EC00000000000": 123.0,
+		"6841D000000007F8F4": 1073741824.12457,
+		"68BFE0000000000000": -0.5,
+		"68C00921FB54442EEA": -3.14159265359,
+		"68C1D000000007F8F4": -1073741824.12457,
+
+		// Floats
+		"040800000000": float32(0.0),
+		"04083F800000": float32(1.0),
+		"04083F8CCCCD": float32(1.1),
+		"04084048F5C3": float32(3.14),
+		"0408461C3FF6": float32(9999.99),
+		"0408BF800000": float32(-1.0),
+		"0408BF8CCCCD": float32(-1.1),
+		"0408C048F5C3": float32(-3.14),
+		"0408C61C3FF6": float32(-9999.99),
+
+		// Signed 32-bit integers
+		"0001":         int32(0),
+		"0401ffffffff": int32(-1),
+		"0101ff":       int32(255),
+		"0401ffffff01": int32(-255),
+		"020101f4":     int32(500),
+		"0401fffffe0c": int32(-500),
+		"0201ffff":     int32(65535),
+		"0401ffff0001": int32(-65535),
+		"0301ffffff":   int32(16777215),
+		"0401ff000001": int32(-16777215),
+		"04017fffffff": int32(2147483647),
+		"040180000001": int32(-2147483647),
+
+		// Unsigned integers
+		"a0":                   uint64(0),
+		"a1ff":                 uint64(255),
+		"a201f4":               uint64(500),
+		"a22a78":               uint64(10872),
+		"a2ffff":               uint64(65535),
+		"c0":                   uint64(0),
+		"c3ffffff":             uint64(16777215),
+		"c4ffffffff":           uint64(4294967295),
+		"0002":                 uint64(0),
+		"020201f4":             uint64(500),
+		"0802ffffffffffffffff": uint64(18446744073709551615),
+
+		// Maps and arrays
+		"e0":                             map[string]interface{}{},
+		"e142656e43466f6f":               map[string]interface{}{"en": "Foo"},
+		"e242656e43466f6f427a6843e4baba": map[string]interface{}{"en": "Foo", "zh": "人"},
+		"e1446e616d65e242656e43466f6f427a6843e4baba": map[string]interface{}{
+			"name": map[string]interface{}{"en": "Foo", "zh": "人"},
+		},
+		"e1496c616e677561676573020442656e427a68": map[string]interface{}{
+			"languages": []interface{}{"en", "zh"},
+		},
+		"0004":                 []interface{}{},
+		"010443466f6f":         []interface{}{"Foo"},
+		"020443466f6f43e4baba": []interface{}{"Foo", "人"},
+
+		// Strings and bytes, including each size encoding
+		"40":       "",
+		"4131":     "1",
+		"43E4BABA": "人",
+		"5b313233343536373839303132333435363738393031323334353637":         "123456789012345678901234567",
+		"5c31323334353637383930313233343536373839303132333435363738":       "1234567890123456789012345678",
+		"5d003132333435363738393031323334353637383930313233343536373839":   "12345678901234567890123456789",
+		"5d01313233343536373839303132333435363738393031323334353637383930": "123456789012345678901234567890",
+		"5e00d7" + strings.Repeat("78", 500):                               strings.Repeat("x", 500),
+		"5e06b3" + strings.Repeat("78", 2000):                              strings.Repeat("x", 2000),
+		"5f001053" + strings.Repeat("78", 70000):                           strings.Repeat("x", 70000),
+		"8131":                                                             []byte("1"),
+		"9e00d7" + strings.Repeat("78", 500):                               []byte(strings.Repeat("x", 500)),
+	}
+	for in, want := range vectors {
+		buf, err := hex.DecodeString(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &mmdbDecoder{buf: buf}
+		have, next, err := d.decode(0)
+		if err != nil {
+			t.Errorf("%.20s: %v", in, err)
+			continue
+		}
+		if next != uint(len(buf)) {
+			t.Errorf("%.20s: expected to consume %d bytes, consumed %d", in, len(buf), next)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%.20s: expected %#v, got %#v", in, want, have)
+		}
+	}
+}
+
+func TestMMDBDecodePointers(t *testing.T) {
+	// {"key": "val"} at offset 0, then a map whose key and value point into
+	// it.
+	buf, err := hex.DecodeString("e1436b65794376616c" + "e120012005")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &mmdbDecoder{buf: buf}
+	want := map[string]interface{}{"key": "val"}
+	for offset, end := range map[uint]uint{0: 9, 9: 14} {
+		have, next, err := d.decode(offset)
+		if err != nil {
+			t.Fatalf("%d: %v", offset, err)
+		}
+		if next != end {
+			t.Errorf("%d: expected the next field at %d, got %d", offset, end, next)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%d: expected %#v, got %#v", offset, want, have)
+		}
+	}
+}
+
+func TestMMDBDecodeTruncated(t *testing.T) {
+	for _, in := range []string{"43E4BA", "68400921FB54", "e142656e", "5e00d7", "20"} {
+		buf, err := hex.DecodeString(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &mmdbDecoder{buf: buf}
+		if _, _, err := d.decode(0); err == nil {
+			t.Errorf("%s: expected an error decoding truncated data", in)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+const tenantsPath = "/tenants/"
+
+var (
+	validTenantID = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,150}$`)
+
+	familiesDesc = prometheus.NewDesc("aggate_families", "Number of metric families currently stored.", []string{"tenant"}, nil)
+	seriesDesc   = prometheus.NewDesc("aggate_series", "Number of series currently stored.", []string{"tenant"}, nil)
+)
+
+// tenants keeps a separate aggregator per tenant, so that different tenants'
+// families never collide or overwrite each other.  With neither header nor
+// fromPath set, every request belongs to the single "" tenant.
+type tenants struct {
+	header   string // Header carrying the tenant ID
+	fromPath bool   // Take the tenant ID from the first segment after the push path
+	label    string // Label carrying the tenant ID on the shared endpoint
+
+	defaults  aggate.Limits
+	overrides map[string]tenantConfig
+	// maxTenants bounds the number of tenants without overrides that may
+	// push (0 for no limit); configuredOnly refuses them altogether.
+	maxTenants     int
+	configuredOnly bool
+	// options configure every tenant's aggregator, apart from its tenant ID,
+	// limits and relabeling rules.
+	options   aggate.Options
+	inject    *injectConfig
+	userAgent *userAgentConfig
+	geoIP     *geoIPConfig
+	// gatherers are served on /metrics alongside the aggregated families.
+	gatherers prometheus.Gatherers
+
+	lock         sync.RWMutex
+	aggates      map[string]*aggate.Aggregator
+	unconfigured int // Number of aggates without overrides
+}
+
+func newTenants(defaults aggate.Limits, overrides map[string]tenantConfig) *tenants {
+	return &tenants{
+		defaults:  defaults,
+		overrides: overrides,
+		aggates:   map[string]*aggate.Aggregator{},
+	}
+}
+
+func (t *tenants) enabled() bool {
+	return t.header != "" || t.fromPath
+}
+
+// tenantID extracts the tenant ID from a push request to pushPath.
+func (t *tenants) tenantID(r *http.Request, pushPath string) (string, error) {
+	var id string
+	switch {
+	case t.header != "":
+		id = r.Header.Get(t.header)
+	case t.fromPath:
+		id = strings.TrimPrefix(r.URL.Path, pushPath)
+		if i := strings.Index(id, "/"); i >= 0 {
+			id = id[:i]
+		}
+	default:
+		return "", nil
+	}
+	if !validTenantID.MatchString(id) {
+		return "", fmt.Errorf("Invalid or missing tenant ID %q", id)
+	}
+	return id, nil
+}
+
+var (
+	// errTooManyTenants is returned by get for a new tenant that would
+	// exceed -max-tenants.
+	errTooManyTenants = errors.New("Too many tenants")
+	// errUnknownTenant is returned by get for a tenant that isn't
+	// configured, with -configured-tenants-only.
+	errUnknownTenant = errors.New("Unknown tenant")
+)
+
+// get returns the aggregator for a tenant, creating it if need be, unless
+// the tenant is new and not allowed to push.
+func (t *tenants) get(id string) (*aggate.Aggregator, error) {
+	t.lock.RLock()
+	a, ok := t.aggates[id]
+	t.lock.RUnlock()
+	if ok {
+		return a, nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if a, ok := t.aggates[id]; ok {
+		return a, nil
+	}
+	_, configured := t.overrides[id]
+	if t.enabled() && !configured {
+		if t.configuredOnly {
+			return nil, errUnknownTenant
+		}
+		if t.maxTenants > 0 && t.unconfigured >= t.maxTenants {
+			return nil, errTooManyTenants
+		}
+		t.unconfigured++
+	}
+	opts := t.options
+	opts.Tenant = id
+	opts.Limits = t.overrides[id].WithDefaults(t.defaults)
+	opts.RelabelConfigs = t.overrides[id].RelabelConfigs
+	a = aggate.New(opts)
+	t.aggates[id] = a
+	return a, nil
+}
+
+// lookup returns the aggregator for a tenant, or nil if it has never pushed.
+func (t *tenants) lookup(id string) *aggate.Aggregator {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.aggates[id]
+}
+
+func (t *tenants) ids() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	ids := make([]string, 0, len(t.aggates))
+	for id := range t.aggates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Describe implements prometheus.Collector.
+func (t *tenants) Describe(ch chan<- *prometheus.Desc) {
+	ch <- familiesDesc
+	ch <- seriesDesc
+}
+
+// Collect implements prometheus.Collector, reporting each tenant's active
+// counts.
+func (t *tenants) Collect(ch chan<- prometheus.Metric) {
+	for _, id := range t.ids() {
+		families, series := t.lookup(id).Counts()
+		ch <- prometheus.MustNewConstMetric(familiesDesc, prometheus.GaugeValue, float64(families), id)
+		ch <- prometheus.MustNewConstMetric(seriesDesc, prometheus.GaugeValue, float64(series), id)
+	}
+}
+
+// pushHandler accepts pushes to pushPath.  Labels are injected from the
+// request, its User-Agent and its location, and then relabelConfigs are
+// applied before the tenant's own rules.  With a tenant label, series
+// carrying it are refused.
+func (t *tenants) pushHandler(pushPath, cors string, relabelConfigs []*aggate.RelabelConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", cors)
+		if r.Method == http.MethodOptions {
+			t.preflight(w)
+			return
+		}
+		id, err := t.tenantID(r, pushPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, err := t.get(id)
+		if err == errUnknownTenant {
+			// Retrying won't help, unlike when there are too many tenants.
+			http.Error(w, fmt.Sprintf("%v %q", err, id), http.StatusForbidden)
+			return
+		} else if err != nil {
+			// Refuse new tenants the same way as any other limit, so
+			// clients back off rather than retry immediately.
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		a.ServePush(w, r,
+			t.inject.transform(r), t.userAgent.transform(r), t.geoIP.transform(r),
+			aggate.RelabelTransform(relabelConfigs), t.checkLabel)
+	}
+}
+
+// checkLabel refuses series carrying the tenant label, which writeLabelled
+// would overwrite with the tenant ID, exposing the series of a family that
+// differ only in it as duplicates.
+func (t *tenants) checkLabel(families map[string]*dto.MetricFamily) error {
+	if t.label == "" {
+		return nil
+	}
+	for name, family := range families {
+		for _, m := range family.Metric {
+			for _, p := range m.Label {
+				if p.GetName() == t.label {
+					return fmt.Errorf("Series of metric '%s' has label '%s', which is reserved for the tenant ID", name, t.label)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// preflight answers a CORS preflight request, allowing browsers to push
+// with any of the headers the gateway reads.
+func (t *tenants) preflight(w http.ResponseWriter) {
+	headers := aggate.PushHeaders()
+	if t.header != "" {
+		headers = append(headers, t.header)
+	}
+	headers = append(headers, t.inject.headers()...)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PUT, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handler serves the shared scrape endpoint.  Without tenancy this is the
+// single tenant's families; with a tenant label it is every tenant's
+// families with the label injected; otherwise it is the tenant named by the
+// request's tenant header.  Any other gatherers are served after them.
+//
+// This deliberately doesn't merge them with prometheus.Gatherers and serve
+// them with promhttp.HandlerFor: that would encode every family on each
+// scrape rather than serving them from the aggregator's cache, and drop the
+// series of families whose label names differ between pushes.  Instead a
+// gatherer's family is skipped if a client pushed one of the same name, as
+// exposing a family twice would make Prometheus reject the whole scrape.
+func (t *tenants) handler(w http.ResponseWriter, r *http.Request) {
+	var scrape func(io.Writer, expfmt.Format) ([]string, error)
+	switch {
+	case !t.enabled():
+		a, _ := t.get("")
+		scrape = a.Scrape
+	case t.label != "":
+		scrape = t.writeLabelled
+	case t.header != "":
+		a, err := t.aggregator(r.Header.Get(t.header))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		scrape = a.Scrape
+	default:
+		http.Error(w, fmt.Sprintf("Scrape a tenant at %s<tenant>/metrics", tenantsPath), http.StatusBadRequest)
+		return
+	}
+
+	contentType := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(contentType))
+	served, err := scrape(w, contentType)
+	if err != nil {
+		http.Error(w, "An error has occurred during metrics encoding:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(t.gatherers) > 0 {
+		t.writeGatherers(w, contentType, served)
+	}
+	if contentType == expfmt.FmtOpenMetrics {
+		expfmt.FinalizeOpenMetrics(w)
+	}
+}
+
+// writeLabelled writes every tenant's families with the tenant label
+// injected, and returns their names.  Tenants may push a family with
+// different label names, so they are encoded as they are rather than
+// checked for consistency.
+func (t *tenants) writeLabelled(w io.Writer, format expfmt.Format) ([]string, error) {
+	enc := expfmt.NewEncoder(w, format)
+	var names []string
+	for _, family := range t.labelledFamilies() {
+		if err := enc.Encode(family); err != nil {
+			return names, err
+		}
+		names = append(names, family.GetName())
+	}
+	return names, nil
+}
+
+// writeGatherers appends the families of the other gatherers to a scrape,
+// skipping any with the name of a family already served.  The aggregated
+// families have already been written, so errors can only be logged.
+func (t *tenants) writeGatherers(w io.Writer, format expfmt.Format, served []string) {
+	families, err := t.gatherers.Gather()
+	if err != nil {
+		log.Printf("Error gathering metrics: %v", err)
+	}
+	skip := make(map[string]struct{}, len(served))
+	for _, name := range served {
+		skip[name] = struct{}{}
+	}
+	enc := expfmt.NewEncoder(w, format)
+	for _, family := range families {
+		if _, ok := skip[family.GetName()]; ok {
+			continue
+		}
+		if err := enc.Encode(family); err != nil {
+			log.Printf("Error encoding metrics: %v", err)
+			return
+		}
+	}
+}
+
+// metadataHandler serves /api/v1/metadata, for the same tenant as handler
+// would scrape.
+func (t *tenants) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case !t.enabled():
+		a, _ := t.get("")
+		a.MetadataHandler().ServeHTTP(w, r)
+	case t.header != "":
+		t.serveTenant(w, r, r.Header.Get(t.header), (*aggate.Aggregator).MetadataHandler)
+	default:
+		http.Error(w, fmt.Sprintf("Get a tenant's metadata at %s<tenant>/metadata", tenantsPath), http.StatusBadRequest)
+	}
+}
+
+// tenantHandler serves /tenants/<tenant>/metrics and
+// /tenants/<tenant>/metadata.
+func (t *tenants) tenantHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, tenantsPath)
+	switch {
+	case strings.HasSuffix(id, "/metrics"):
+		t.scrapeTenant(w, r, strings.TrimSuffix(id, "/metrics"))
+	case strings.HasSuffix(id, "/metadata"):
+		t.serveTenant(w, r, strings.TrimSuffix(id, "/metadata"), (*aggate.Aggregator).MetadataHandler)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (t *tenants) scrapeTenant(w http.ResponseWriter, r *http.Request, id string) {
+	t.serveTenant(w, r, id, (*aggate.Aggregator).ScrapeHandler)
+}
+
+// serveTenant serves a request with one of the tenant's handlers.
+func (t *tenants) serveTenant(w http.ResponseWriter, r *http.Request, id string, handler func(*aggate.Aggregator) http.Handler) {
+	a, err := t.aggregator(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handler(a).ServeHTTP(w, r)
+}
+
+// aggregator returns the aggregator to serve for a tenant, which is empty if
+// the tenant has never pushed.
+func (t *tenants) aggregator(id string) (*aggate.Aggregator, error) {
+	if !validTenantID.MatchString(id) {
+		return nil, fmt.Errorf("Invalid or missing tenant ID %q", id)
+	}
+	if a := t.lookup(id); a != nil {
+		return a, nil
+	}
+	return aggate.New(aggate.Options{}), nil
+}
+
+// labelledFamilies merges every tenant's families, adding t.label to each
+// series.  Families whose type differs from the first tenant to define them
+// are skipped, as they cannot be exposed under the same name.
+func (t *tenants) labelledFamilies() []*dto.MetricFamily {
+	merged := map[string]*dto.MetricFamily{}
+	for _, id := range t.ids() {
+		for _, family := range t.lookup(id).Snapshot() {
+			output, ok := merged[family.GetName()]
+			if !ok {
+				output = &dto.MetricFamily{
+					Name: family.Name,
+					Help: family.Help,
+					Type: family.Type,
+				}
+				merged[family.GetName()] = output
+			} else if output.GetType() != family.GetType() {
+				continue
+			}
+			for _, m := range family.Metric {
+				output.Metric = append(output.Metric, withLabel(m, t.label, id))
+			}
+		}
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(merged))
+	for _, family := range merged {
+		sort.Sort(aggate.ByLabel(family.Metric))
+		families = append(families, family)
+	}
+	sort.Sort(aggate.ByFamilyName(families))
+	return families
+}
+
+// withLabel returns a shallow copy of m with the label name set to value,
+// replacing any label of the same name the client sent.
+func withLabel(m *dto.Metric, name, value string) *dto.Metric {
+	labels := make([]*dto.LabelPair, 0, len(m.Label)+1)
+	for _, p := range m.Label {
+		if p.GetName() != name {
+			labels = append(labels, p)
+		}
+	}
+	labels = append(labels, &dto.LabelPair{Name: &name, Value: &value})
+	sort.Sort(aggate.ByName(labels))
+
+	output := *m
+	output.Label = labels
+	return &output
+}
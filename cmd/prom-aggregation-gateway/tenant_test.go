@@ -0,0 +1,303 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+const (
+	multilabel1 = `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b"} 1
+`
+	multilabel2 = `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b"} 2
+`
+	labelFields2 = `# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/prom/:orgId"} 1
+`
+	twoFamilies = `# TYPE counter counter
+counter 31
+# TYPE gauge gauge
+gauge 42
+`
+)
+
+func push(h http.Handler, path, header, tenant, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader(body))
+	if header != "" {
+		r.Header.Set(header, tenant)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func scrape(h http.Handler, path, header, tenant string) string {
+	r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	if header != "" {
+		r.Header.Set(header, tenant)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Body.String()
+}
+
+func newTestMux(t *tenants) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", t.handler)
+	mux.HandleFunc(tenantsPath, t.tenantHandler)
+	mux.HandleFunc("/api/v1/metadata", t.metadataHandler)
+	mux.HandleFunc("/metrics/", t.pushHandler("/metrics/", "*", nil))
+	return mux
+}
+
+func TestTenantsByHeader(t *testing.T) {
+	ts := newTenants(aggate.Limits{}, nil)
+	ts.header = "X-Scope-OrgID"
+	mux := newTestMux(ts)
+
+	for _, tenant := range []string{"a", "b", "a"} {
+		if w := push(mux, "/metrics/", ts.header, tenant, multilabel1); w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+		}
+	}
+	if w := push(mux, "/metrics/", "", "", multilabel1); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without a tenant, got %d", w.Code)
+	}
+
+	want := `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b"} 2
+`
+	if have := scrape(mux, "/metrics", ts.header, "a"); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+	if have := scrape(mux, "/tenants/a/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+	if have := scrape(mux, "/tenants/b/metrics", "", ""); have != multilabel1 {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", multilabel1, have)
+	}
+}
+
+func TestTenantsByPathWithLabel(t *testing.T) {
+	ts := newTenants(aggate.Limits{}, nil)
+	ts.fromPath = true
+	ts.label = "tenant"
+	mux := newTestMux(ts)
+
+	push(mux, "/metrics/b/", "", "", multilabel2)
+	push(mux, "/metrics/a", "", "", multilabel1)
+
+	want := `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b",tenant="a"} 1
+counter{a="a",b="b",tenant="b"} 2
+`
+	if have := scrape(mux, "/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+
+	// Series of their own with the tenant label would become duplicates.
+	w := push(mux, "/metrics/a", "", "", "c{tenant=\"x\"} 1\nc{tenant=\"y\"} 2\n")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "reserved for the tenant ID") {
+		t.Fatalf("Expected 400 for a push with the tenant label, got %d: %s", w.Code, w.Body)
+	}
+	if have := scrape(mux, "/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	ts := newTenants(aggate.Limits{MaxFamilies: 1}, map[string]tenantConfig{"big": {Limits: aggate.Limits{MaxFamilies: 10}}})
+	ts.header = "X-Scope-OrgID"
+	mux := newTestMux(ts)
+
+	if w := push(mux, "/metrics/", ts.header, "small", twoFamilies); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	if w := push(mux, "/metrics/", ts.header, "big", twoFamilies); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestMaxTenants(t *testing.T) {
+	ts := newTenants(aggate.Limits{}, map[string]tenantConfig{"configured": {}})
+	ts.header = "X-Scope-OrgID"
+	ts.maxTenants = 2
+	mux := newTestMux(ts)
+
+	for _, tenant := range []string{"a", "b", "a", "configured"} {
+		if w := push(mux, "/metrics/", ts.header, tenant, multilabel1); w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d for tenant %s: %s", w.Code, tenant, w.Body)
+		}
+	}
+	if w := push(mux, "/metrics/", ts.header, "c", multilabel1); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for a tenant over the limit, got %d", w.Code)
+	}
+	if ids := ts.ids(); len(ids) != 3 {
+		t.Fatalf("Expected 3 tenants, got %v", ids)
+	}
+
+	ts.configuredOnly = true
+	if w := push(mux, "/metrics/", ts.header, "d", multilabel1); w.Code != http.StatusForbidden || w.Body.String() != "Unknown tenant \"d\"\n" {
+		t.Fatalf("Expected 403 for an unconfigured tenant, got %d: %s", w.Code, w.Body)
+	}
+	if w := push(mux, "/metrics/", ts.header, "configured", multilabel1); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPushPreflight(t *testing.T) {
+	ts := newTenants(aggate.Limits{}, nil)
+	ts.header = "X-Scope-OrgID"
+	mux := newTestMux(ts)
+
+	r := httptest.NewRequest("OPTIONS", "http://example.com/metrics/", nil)
+	r.Header.Set("Origin", "https://example.org")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "idempotency-key,x-sample-rate,x-scope-orgid")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if have := w.Header().Get("Access-Control-Allow-Origin"); have != "*" {
+		t.Fatalf("Expected any origin to be allowed, got %q", have)
+	}
+	if have := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(have, "POST") {
+		t.Fatalf("Expected POST to be allowed, got %q", have)
+	}
+	want := "Content-Type, Idempotency-Key, X-Sample-Rate, X-Scope-OrgID"
+	if have := w.Header().Get("Access-Control-Allow-Headers"); have != want {
+		t.Fatalf("Expected allowed headers %q, got %q", want, have)
+	}
+	if ids := ts.ids(); len(ids) != 0 {
+		t.Fatalf("Preflight should not create tenants, have %v", ids)
+	}
+}
+
+func TestTenantMetadata(t *testing.T) {
+	ts := newTenants(aggate.Limits{}, nil)
+	ts.fromPath = true
+	mux := newTestMux(ts)
+	push(mux, "/metrics/a", "", "", multilabel1)
+
+	want := `[{"name":"counter","type":"counter","help":"A counter","unit":"","series":1,"help_variants":[{"help":"A counter","pushes":1}]}]` + "\n"
+	if have := scrape(mux, "/tenants/a/metadata", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+	if have := scrape(mux, "/tenants/b/metadata", "", ""); have != "[]\n" {
+		t.Fatalf("Expected no metadata for unknown tenant, got:\n%s", have)
+	}
+}
+
+func TestScrapeWithGatherers(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "aggate_up", Help: "Whether the gateway is up"}))
+	ts := newTenants(aggate.Limits{}, nil)
+	ts.header = "X-Scope-OrgID"
+	ts.gatherers = prometheus.Gatherers{reg}
+	mux := newTestMux(ts)
+	push(mux, "/metrics/", ts.header, "a", multilabel1)
+
+	want := `# HELP counter A counter
+# TYPE counter counter
+counter{a="a",b="b"} 1
+# HELP aggate_up Whether the gateway is up
+# TYPE aggate_up gauge
+aggate_up 0
+`
+	if have := scrape(mux, "/metrics", ts.header, "a"); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+	// OpenMetrics ends once, after the other gatherers' families.
+	r := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+	r.Header.Set(ts.header, "a")
+	r.Header.Set("Accept", string(expfmt.FmtOpenMetrics))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	want = `# HELP counter A counter
+# TYPE counter unknown
+counter{a="a",b="b"} 1.0
+# HELP aggate_up Whether the gateway is up
+# TYPE aggate_up gauge
+aggate_up 0.0
+# EOF
+`
+	if have := w.Body.String(); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+	// Per-tenant endpoints serve only the tenant's families.
+	if have := scrape(mux, "/tenants/a/metrics", "", ""); have != multilabel1 {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", multilabel1, have)
+	}
+	if have := scrape(mux, "/metrics", ts.header, "a b"); !strings.Contains(have, "Invalid or missing tenant ID") {
+		t.Fatalf("Expected an invalid tenant to be refused, got:\n%s", have)
+	}
+}
+
+// A client pushing a family named like one of the gateway's own must not
+// make it exposed twice, or Prometheus would reject the whole scrape.
+func TestScrapeWithGatherersSkipsPushedNames(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGoCollector())
+	ts := newTenants(aggate.Limits{}, nil)
+	ts.gatherers = prometheus.Gatherers{reg}
+	mux := newTestMux(ts)
+	if w := push(mux, "/metrics/", "", "", "go_goroutines 5\n"); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	have := scrape(mux, "/metrics", "", "")
+	if n := strings.Count(have, "# TYPE go_goroutines "); n != 1 {
+		t.Fatalf("Expected go_goroutines once, got %d times:\n%s", n, have)
+	}
+	if !strings.Contains(have, "go_goroutines 5\n") {
+		t.Fatalf("Expected the pushed go_goroutines, got:\n%s", have)
+	}
+	if !strings.Contains(have, "# TYPE go_gc_duration_seconds summary\n") {
+		t.Fatalf("Expected the gateway's other Go metrics, got:\n%s", have)
+	}
+}
+
+func TestScrapeMixedLabelNames(t *testing.T) {
+	const mixed = `# TYPE c counter
+c{loaded="true",path="/b"} 2
+c{path="/a"} 1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "aggate_up", Help: "Whether the gateway is up"}))
+	for _, c := range []struct {
+		name string
+		ts   *tenants
+		want string
+	}{
+		{"single tenant", newTenants(aggate.Limits{}, nil), mixed},
+		{"tenant label", &tenants{fromPath: true, label: "tenant", aggates: map[string]*aggate.Aggregator{}}, `# TYPE c counter
+c{loaded="true",path="/b",tenant="a"} 2
+c{path="/a",tenant="a"} 1
+`},
+	} {
+		c.ts.gatherers = prometheus.Gatherers{reg}
+		mux := newTestMux(c.ts)
+		if w := push(mux, "/metrics/a", "", "", mixed); w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", c.name, w.Code, w.Body)
+		}
+		want := c.want + "# HELP aggate_up Whether the gateway is up\n# TYPE aggate_up gauge\naggate_up 0\n"
+		if have := scrape(mux, "/metrics", "", ""); have != want {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", c.name, want, have)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+//go:build ignore
+// +build ignore
+
+// mkgeoip writes synthetic-country.mmdb, a tiny database in the MaxMind DB
+// format used by the GeoIP tests so they can run offline.  Its networks
+// mirror some of MaxMind's own test databases, but it is written here, not by
+// MaxMind.  Run it with:
+//
+//	go run testdata/mkgeoip.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+)
+
+var networks = []struct {
+	cidr, country, continent string
+}{
+	{"81.2.69.0/24", "GB", "EU"},
+	{"89.160.20.0/24", "SE", "EU"},
+	{"216.160.83.0/24", "US", "NA"},
+	{"175.16.199.0/24", "CN", "AS"},
+	{"202.196.224.0/20", "", "AS"},
+	{"2a02:cf40::/29", "DE", "EU"},
+}
+
+type node struct {
+	child [2]*node
+	leaf  [2]int
+}
+
+func newNode() *node {
+	return &node{leaf: [2]int{-1, -1}}
+}
+
+func main() {
+	var data bytes.Buffer
+	root := newNode()
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// IPv4 networks live under ::/96, as in MaxMind's own databases.
+		ip := ipnet.IP.To16()
+		ones, bits := ipnet.Mask.Size()
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			ip = make(net.IP, net.IPv6len)
+			copy(ip[12:], ip4)
+		}
+		if bits == 32 {
+			ones += 96
+		}
+
+		record := map[string]interface{}{}
+		if n.country != "" {
+			record["country"] = map[string]interface{}{"iso_code": n.country}
+		}
+		record["continent"] = map[string]interface{}{"code": n.continent}
+		offset := data.Len()
+		encode(&data, record)
+
+		cur := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> uint(7-i%8)) & 1
+			if i == ones-1 {
+				cur.leaf[bit] = offset
+				break
+			}
+			if cur.child[bit] == nil {
+				cur.child[bit] = newNode()
+			}
+			cur = cur.child[bit]
+		}
+	}
+
+	var nodes []*node
+	var number func(n *node)
+	index := map[*node]int{}
+	number = func(n *node) {
+		index[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if c != nil {
+				number(c)
+			}
+		}
+	}
+	number(root)
+
+	nodeCount := len(nodes)
+	var out bytes.Buffer
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := nodeCount
+			if n.child[bit] != nil {
+				record = index[n.child[bit]]
+			} else if n.leaf[bit] >= 0 {
+				record = nodeCount + 16 + n.leaf[bit]
+			}
+			out.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encode(&out, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"database_type":               "Synthetic-Country",
+		"description":                 map[string]interface{}{"en": "Test fixture for prom-aggregation-gateway"},
+		"ip_version":                  uint16(6),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	})
+
+	if err := ioutil.WriteFile("testdata/synthetic-country.mmdb", out.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func control(buf *bytes.Buffer, typ, size int) {
+	if size >= 285 {
+		log.Fatalf("size %d too large", size)
+	}
+	sizeField := size
+	if size >= 29 {
+		sizeField = 29
+	}
+	if typ <= 7 {
+		buf.WriteByte(byte(typ<<5 | sizeField))
+	} else {
+		buf.WriteByte(byte(sizeField))
+		buf.WriteByte(byte(typ - 7))
+	}
+	if size >= 29 {
+		buf.WriteByte(byte(size - 29))
+	}
+}
+
+func encode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		control(buf, 2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		control(buf, 5, 2)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint32:
+		control(buf, 6, 4)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		control(buf, 9, 8)
+		binary.Write(buf, binary.BigEndian, v)
+	case []interface{}:
+		control(buf, 11, len(v))
+		for _, e := range v {
+			encode(buf, e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		control(buf, 7, len(keys))
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, v[k])
+		}
+	default:
+		log.Fatalf("cannot encode %T", v)
+	}
+}
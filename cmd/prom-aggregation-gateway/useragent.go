@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+const other = "other"
+
+// Labels userAgentConfig can attach.
+const (
+	uaBrowser        = "browser"
+	uaBrowserVersion = "browser_version"
+	uaOS             = "os"
+	uaDevice         = "device"
+)
+
+// Browsers in the order they must be tried, as many User-Agents mention
+// several: Edge's also says Chrome and Safari, for instance.
+var browserPatterns = []struct {
+	family string
+	regex  *regexp.Regexp
+}{
+	{"edge", regexp.MustCompile(`\b(?:Edge?|EdgA|EdgiOS)/(\d+)`)},
+	{"opera", regexp.MustCompile(`\b(?:OPR|Opera)/(\d+)`)},
+	{"samsung", regexp.MustCompile(`\bSamsungBrowser/(\d+)`)},
+	{"firefox", regexp.MustCompile(`\b(?:Firefox|FxiOS)/(\d+)`)},
+	{"chrome", regexp.MustCompile(`\b(?:Chrome|CriOS)/(\d+)`)},
+	{"safari", regexp.MustCompile(`\bVersion/(\d+).*\bSafari/`)},
+	{"ie", regexp.MustCompile(`\b(?:MSIE |Trident/.*rv:)(\d+)`)},
+}
+
+var osPatterns = []struct {
+	family string
+	regex  *regexp.Regexp
+}{
+	{"windows", regexp.MustCompile(`\bWindows`)},
+	{"ios", regexp.MustCompile(`\b(?:iPhone|iPad|iPod)\b`)},
+	{"android", regexp.MustCompile(`\bAndroid\b`)},
+	{"chromeos", regexp.MustCompile(`\bCrOS\b`)},
+	{"macos", regexp.MustCompile(`\bMac OS X\b|\bMacintosh\b`)},
+	{"linux", regexp.MustCompile(`\bLinux\b`)},
+}
+
+var (
+	botRegex    = regexp.MustCompile(`(?i)bot\b|crawl|spider|slurp|headless|lighthouse`)
+	tabletRegex = regexp.MustCompile(`\biPad\b|\bTablet\b`)
+	mobileRegex = regexp.MustCompile(`\bMobi|\biPhone\b|\biPod\b`)
+)
+
+// userAgentConfig parses the push request's User-Agent into a few bounded,
+// low-cardinality labels and attaches them to the configured families.
+type userAgentConfig struct {
+	// Families lists the families to attach labels to.
+	Families []string `json:"families"`
+	// Labels lists which of browser, browser_version, os and device to
+	// attach; all of them if empty.
+	Labels []string `json:"labels"`
+	// VersionBucket is the width of the browser_version buckets; 10 if
+	// unset, so Chrome 123 becomes "120".
+	VersionBucket int `json:"version_bucket"`
+
+	families map[string]struct{}
+	labels   []*injectLabel
+}
+
+func (c *userAgentConfig) compile() error {
+	c.families = make(map[string]struct{}, len(c.Families))
+	for _, name := range c.Families {
+		c.families[name] = struct{}{}
+	}
+	if len(c.Labels) == 0 {
+		c.Labels = []string{uaBrowser, uaBrowserVersion, uaOS, uaDevice}
+	}
+	for _, l := range c.Labels {
+		switch l {
+		case uaBrowser, uaBrowserVersion, uaOS, uaDevice:
+		default:
+			return fmt.Errorf("Unknown User-Agent label %q", l)
+		}
+		c.labels = append(c.labels, &injectLabel{Label: l, OnConflict: conflictOverride})
+	}
+	if c.VersionBucket == 0 {
+		c.VersionBucket = 10
+	} else if c.VersionBucket < 0 {
+		return fmt.Errorf("version_bucket must be positive")
+	}
+	return nil
+}
+
+// userAgent is a User-Agent reduced to a few low-cardinality fields.
+type userAgent struct {
+	browser, browserVersion, os, device string
+}
+
+func (c *userAgentConfig) parse(ua string) userAgent {
+	result := userAgent{browser: other, browserVersion: other, os: other, device: other}
+	for _, p := range browserPatterns {
+		if m := p.regex.FindStringSubmatch(ua); m != nil {
+			result.browser = p.family
+			if major, err := strconv.Atoi(m[1]); err == nil {
+				result.browserVersion = strconv.Itoa(major / c.VersionBucket * c.VersionBucket)
+			}
+			break
+		}
+	}
+	for _, p := range osPatterns {
+		if p.regex.MatchString(ua) {
+			result.os = p.family
+			break
+		}
+	}
+	switch {
+	case botRegex.MatchString(ua):
+		result.device = "bot"
+	case tabletRegex.MatchString(ua) || (result.os == "android" && !mobileRegex.MatchString(ua)):
+		result.device = "tablet"
+	case mobileRegex.MatchString(ua):
+		result.device = "mobile"
+	case result.os == "windows" || result.os == "macos" || result.os == "linux" || result.os == "chromeos":
+		result.device = "desktop"
+	}
+	return result
+}
+
+// transform returns a transform attaching labels parsed from r's User-Agent
+// to the configured families, replacing any the client sent.
+func (c *userAgentConfig) transform(r *http.Request) aggate.Transform {
+	return func(families map[string]*dto.MetricFamily) error {
+		if c == nil {
+			return nil
+		}
+		ua := c.parse(r.UserAgent())
+		values := map[string]string{
+			uaBrowser:        ua.browser,
+			uaBrowserVersion: ua.browserVersion,
+			uaOS:             ua.os,
+			uaDevice:         ua.device,
+		}
+
+		for name, family := range families {
+			if _, ok := c.families[name]; !ok {
+				continue
+			}
+			if err := injectFamily(family, c.labels, func(i int) string { return values[c.labels[i].Label] }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
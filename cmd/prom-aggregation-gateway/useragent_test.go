@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/weaveworks/prom-aggregation-gateway/aggate"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	c := &userAgentConfig{}
+	if err := c.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ua   string
+		want userAgent
+	}{
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/123.0.0.0 Safari/537.36",
+			userAgent{"chrome", "120", "windows", "desktop"},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			userAgent{"edge", "120", "windows", "desktop"},
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_2) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			userAgent{"safari", "10", "macos", "desktop"},
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			userAgent{"safari", "10", "ios", "mobile"},
+		},
+		{
+			"Mozilla/5.0 (iPad; CPU OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			userAgent{"chrome", "120", "ios", "tablet"},
+		},
+		{
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			userAgent{"firefox", "120", "linux", "desktop"},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 13; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36",
+			userAgent{"samsung", "20", "android", "mobile"},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			userAgent{"other", "other", "other", "bot"},
+		},
+		{"curl/8.4.0", userAgent{"other", "other", "other", "other"}},
+		{"", userAgent{"other", "other", "other", "other"}},
+	} {
+		if have := c.parse(tc.ua); have != tc.want {
+			t.Errorf("%q: expected %v, got %v", tc.ua, tc.want, have)
+		}
+	}
+}
+
+func TestUserAgentLabels(t *testing.T) {
+	c := &userAgentConfig{Families: []string{"ui_page_render_errors"}, Labels: []string{"browser", "os"}}
+	if err := c.compile(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "http://example.com/metrics/", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+
+	a := aggate.New(aggate.Options{})
+	in := `# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{path="/org/:orgId",browser="spoofed"} 1
+# HELP counter A counter
+# TYPE counter counter
+counter 1
+`
+	if err := a.Push(strings.NewReader(in), c.transform(r)); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP counter A counter
+# TYPE counter counter
+counter 1
+# HELP ui_page_render_errors A counter
+# TYPE ui_page_render_errors counter
+ui_page_render_errors{browser="firefox",os="linux",path="/org/:orgId"} 1
+`
+	if have := scrape(a.ScrapeHandler(), "/metrics", "", ""); have != want {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", want, have)
+	}
+}